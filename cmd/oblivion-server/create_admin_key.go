@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/db"
+)
+
+// runCreateAdminKey creates an admin API key and prints the plaintext key,
+// which is not stored and can only be seen once.
+func runCreateAdminKey(args []string) {
+	var scopeNames []string
+	for _, scope := range db.AdminScopes {
+		scopeNames = append(scopeNames, string(scope))
+	}
+
+	flagSet := flag.NewFlagSet("create-admin-key", flag.ExitOnError)
+	name := flagSet.String("name", "", "Name of the admin key")
+	scopes := flagSet.String("scopes", "", "Comma-separated scopes of the admin key: "+strings.Join(scopeNames, ", "))
+	config := newConfigFlags(flagSet)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s create-admin-key [--config <file>] [--dev] --name <name> --scopes <scopes>\n", os.Args[0])
+		flagSet.PrintDefaults()
+	}
+	_ = flagSet.Parse(args)
+	if *name == "" || *scopes == "" {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+	config.load()
+
+	var adminScopes []db.AdminScope
+	for _, scope := range strings.Split(*scopes, ",") {
+		adminScopes = append(adminScopes, db.AdminScope(strings.TrimSpace(scope)))
+	}
+
+	if _, err := db.Init(); err != nil {
+		log.Fatal("Failed to init database: %v", err)
+	}
+
+	adminKey, err := db.AdminKeys.Create(context.Background(), db.CreateAdminKeyOptions{
+		Name:   *name,
+		Scopes: adminScopes,
+	})
+	if err != nil {
+		log.Fatal("Failed to create admin key: %v", err)
+	}
+	fmt.Println(adminKey.Key)
+}
+
+// runListAdminKeys prints the ID, the name, the scopes and the creation time
+// of every admin API key.
+func runListAdminKeys(args []string) {
+	flagSet := flag.NewFlagSet("list-admin-keys", flag.ExitOnError)
+	config := newConfigFlags(flagSet)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s list-admin-keys [--config <file>] [--dev]\n", os.Args[0])
+		flagSet.PrintDefaults()
+	}
+	_ = flagSet.Parse(args)
+	config.load()
+
+	if _, err := db.Init(); err != nil {
+		log.Fatal("Failed to init database: %v", err)
+	}
+
+	adminKeys, err := db.AdminKeys.List(context.Background())
+	if err != nil {
+		log.Fatal("Failed to list admin keys: %v", err)
+	}
+	for _, adminKey := range adminKeys {
+		var scopes []string
+		for _, scope := range adminKey.GetScopes() {
+			scopes = append(scopes, string(scope))
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\n", adminKey.ID, adminKey.Name, strings.Join(scopes, ","), adminKey.CreatedAt.Format(time.RFC3339))
+	}
+}
+
+// runRevokeAdminKey deletes the admin API key of the given ID, which is
+// rejected right away.
+func runRevokeAdminKey(args []string) {
+	flagSet := flag.NewFlagSet("revoke-admin-key", flag.ExitOnError)
+	id := flagSet.Uint("id", 0, "ID of the admin key, as printed by list-admin-keys")
+	config := newConfigFlags(flagSet)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s revoke-admin-key [--config <file>] [--dev] --id <id>\n", os.Args[0])
+		flagSet.PrintDefaults()
+	}
+	_ = flagSet.Parse(args)
+	if *id == 0 {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+	config.load()
+
+	if _, err := db.Init(); err != nil {
+		log.Fatal("Failed to init database: %v", err)
+	}
+
+	if err := db.AdminKeys.Delete(context.Background(), *id); err != nil {
+		log.Fatal("Failed to revoke admin key: %v", err)
+	}
+	log.Info("Revoked admin key %d", *id)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/userutil"
+)
+
+// runImportUsers creates users from a CSV or JSON list of tokens, or with
+// randomly generated tokens, and prints the token and the generated domain of
+// each user. The tokens are stored hashed so this is the only chance to see
+// the generated ones.
+func runImportUsers(args []string) {
+	flagSet := flag.NewFlagSet("import-users", flag.ExitOnError)
+	format := flagSet.String("format", "", `Format of the tokens file, "csv" or "json" (default: by file extension)`)
+	generate := flagSet.Int("generate", 0, "Number of users to create with random tokens")
+	config := newConfigFlags(flagSet)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s import-users [--config <file>] [--dev] [--format csv|json] [--generate <n>] [<file>]\n", os.Args[0])
+		flagSet.PrintDefaults()
+	}
+	_ = flagSet.Parse(args)
+	if flagSet.NArg() > 1 || (flagSet.NArg() == 0 && *generate <= 0) {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+	config.load()
+
+	var tokens []string
+	if flagSet.NArg() == 1 {
+		file := flagSet.Arg(0)
+		tokensFormat := userutil.TokensFormat(*format)
+		if tokensFormat == "" {
+			tokensFormat = userutil.TokensFormat(strings.TrimPrefix(filepath.Ext(file), "."))
+		}
+
+		var r io.Reader = os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				log.Fatal("Failed to open tokens file: %v", err)
+			}
+			defer func() { _ = f.Close() }()
+			r = f
+		}
+
+		var err error
+		tokens, err = userutil.ParseTokens(r, tokensFormat)
+		if err != nil {
+			log.Fatal("Failed to parse tokens: %v", err)
+		}
+	}
+
+	if _, err := db.Init(); err != nil {
+		log.Fatal("Failed to init database: %v", err)
+	}
+
+	users, err := db.Users.BatchCreate(context.Background(), db.BatchCreateOptions{
+		Tokens:   tokens,
+		Generate: *generate,
+	})
+	if err != nil {
+		var duplicateErr *db.DuplicateUsersError
+		if errors.As(err, &duplicateErr) {
+			log.Fatal("Failed to import users, duplicate tokens: %s", strings.Join(duplicateErr.Tokens, ", "))
+		}
+		log.Fatal("Failed to import users: %v", err)
+	}
+
+	for _, user := range users {
+		fmt.Printf("%s\t%s\n", user.Token, user.Domain)
+	}
+	log.Info("Imported %d users", len(users))
+}
@@ -1,19 +1,12 @@
 package main
 
 import (
-	"io/ioutil"
-	"net"
+	"flag"
 	"os"
 
-	"github.com/flamego/flamego"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	log "unknwon.dev/clog/v2"
 
-	"github.com/wuhan005/oblivion/internal/context"
-	"github.com/wuhan005/oblivion/internal/cron"
-	"github.com/wuhan005/oblivion/internal/db"
-	"github.com/wuhan005/oblivion/internal/route"
+	"github.com/wuhan005/oblivion/internal/conf"
 )
 
 func main() {
@@ -23,47 +16,45 @@ func main() {
 		panic(err)
 	}
 
-	const (
-		tokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
-	)
-	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
-	token, err := ioutil.ReadFile(tokenFile)
-	if err != nil {
-		log.Fatal("Failed to get token: %v", err)
-	}
-
-	k8sClient, err := kubernetes.NewForConfig(&rest.Config{
-		Host: "https://" + net.JoinHostPort(host, port),
-		TLSClientConfig: rest.TLSClientConfig{
-			Insecure: true,
-		},
-		BearerToken:     string(token),
-		BearerTokenFile: tokenFile,
-	})
-	if err != nil {
-		log.Fatal("Failed to get k8s client: %v", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-users":
+			runImportUsers(os.Args[2:])
+			return
+		case "create-admin-key":
+			runCreateAdminKey(os.Args[2:])
+			return
+		case "list-admin-keys":
+			runListAdminKeys(os.Args[2:])
+			return
+		case "revoke-admin-key":
+			runRevokeAdminKey(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		}
 	}
-	database, err := db.Init()
-	if err != nil {
-		log.Fatal("Failed to init database: %v", err)
-	}
-
-	cron.Start(k8sClient)
-
-	f := flamego.Classic()
-	f.Use(flamego.Renderer())
-	f.Map(k8sClient)
+	runWeb(os.Args[1:])
+}
 
-	f.Use(context.Contexter(database))
+// configFlags are the flags shared by all the commands to load the
+// configuration.
+type configFlags struct {
+	path *string
+	dev  *bool
+}
 
-	f.Get("/health", func() {})
-	f.Group("/api", func() {
-		f.Group("/env/{uid}", func() {
-			f.Combo("").
-				Get(route.CreatePod).
-				Delete(route.DeletePod)
-		}, route.Enver)
-	}, route.UserAuther)
+func newConfigFlags(flagSet *flag.FlagSet) *configFlags {
+	return &configFlags{
+		path: flagSet.String("config", os.Getenv("OBLIVION_CONFIG"), "Path to the YAML config file (default: $OBLIVION_CONFIG)"),
+		dev:  flagSet.Bool("dev", false, "Run in development mode with in-memory instances and a SQLite database"),
+	}
+}
 
-	f.Run(4000)
+// load loads the configuration and exits on invalid settings.
+func (f *configFlags) load() {
+	if err := conf.Init(*f.path, *f.dev); err != nil {
+		log.Fatal("Failed to load config: %v", err)
+	}
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/db"
+)
+
+// runMigrate shows the status of the database migrations, applies the pending
+// ones, or reverts the applied ones.
+func runMigrate(args []string) {
+	flagSet := flag.NewFlagSet("migrate", flag.ExitOnError)
+	config := newConfigFlags(flagSet)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), `Usage: %s migrate [--config <file>] [--dev] <command> [<n>]
+
+Commands:
+  status    Show the status of the migrations
+  up        Apply the next n pending migrations (default: all)
+  down      Revert the last n applied migrations (default: 1)
+`, os.Args[0])
+		flagSet.PrintDefaults()
+	}
+	_ = flagSet.Parse(args)
+	if flagSet.NArg() == 0 || flagSet.NArg() > 2 {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+
+	var n int
+	if flagSet.NArg() == 2 {
+		var err error
+		n, err = strconv.Atoi(flagSet.Arg(1))
+		if err != nil || n <= 0 {
+			flagSet.Usage()
+			os.Exit(2)
+		}
+	}
+	config.load()
+
+	database, err := db.Open()
+	if err != nil {
+		log.Fatal("Failed to open database: %v", err)
+	}
+
+	switch flagSet.Arg(0) {
+	case "status":
+		statuses, err := db.MigrationStatuses(database)
+		if err != nil {
+			log.Fatal("Failed to get migration statuses: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			if status.Version > db.LatestSchemaVersion {
+				appliedAt += " (unknown to this binary)"
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		_ = w.Flush()
+
+	case "up":
+		if err := db.MigrateUp(database, n); err != nil {
+			log.Fatal("Failed to apply migrations: %v", err)
+		}
+
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		if err := db.MigrateDown(database, n); err != nil {
+			log.Fatal("Failed to revert migrations: %v", err)
+		}
+
+	default:
+		flagSet.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	gocontext "context"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/flamego/flamego"
+	"k8s.io/client-go/kubernetes"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/conf"
+	"github.com/wuhan005/oblivion/internal/context"
+	"github.com/wuhan005/oblivion/internal/cron"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/event"
+	"github.com/wuhan005/oblivion/internal/kubeutil"
+	"github.com/wuhan005/oblivion/internal/orchestrator"
+	"github.com/wuhan005/oblivion/internal/route"
+)
+
+func runWeb(args []string) {
+	flagSet := flag.NewFlagSet("web", flag.ExitOnError)
+	config := newConfigFlags(flagSet)
+	kubeconfig := flagSet.String("kubeconfig", "", "Path to the kubeconfig file, overrides the config file (default: $KUBECONFIG, or the in-cluster service account)")
+	insecureSkipTLSVerify := flagSet.Bool("kube-insecure-skip-tls-verify", false, "Skip verifying the certificate of the Kubernetes API server, insecure")
+	_ = flagSet.Parse(args)
+
+	config.load()
+	if *kubeconfig != "" {
+		conf.Kubernetes.Kubeconfig = *kubeconfig
+	}
+	if *insecureSkipTLSVerify {
+		conf.Kubernetes.InsecureSkipTLSVerify = true
+	}
+
+	if conf.Auth.EnableQueryToken {
+		log.Warn("Passing the player token with the \"?token=\" query parameter is deprecated, set auth.enable_query_token to false to disable it")
+	}
+
+	database, err := db.Init()
+	if err != nil {
+		log.Fatal("Failed to init database: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(gocontext.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hub := event.NewHub()
+	runner := cron.NewRunner()
+
+	var provisioner orchestrator.Provisioner
+	if conf.Dev.Enabled {
+		log.Warn("Running in development mode, the instances are simulated in memory and stored in %q", conf.Database.Path)
+		provisioner = orchestrator.NewMemoryProvisioner(orchestrator.MemoryOptions{
+			ReadyDelay:  conf.Dev.ReadyDelay,
+			FailureRate: conf.Dev.FailureRate,
+			ErrorRate:   conf.Dev.ErrorRate,
+			OnStatus:    hub.PublishStatus,
+		})
+	} else {
+		k8sClient := newKubernetesClient()
+		if err := kubeutil.MigrateLegacyLabels(ctx, k8sClient); err != nil {
+			log.Error("Failed to migrate legacy labels: %v", err)
+		}
+		provisioner = orchestrator.NewKubernetesProvisioner(k8sClient)
+
+		informerFactory := kubeutil.NewInformerFactory(k8sClient)
+		event.WatchPods(informerFactory, hub)
+		runner.Start(ctx, cron.ReconcileJob(provisioner, informerFactory, hub))
+		informerFactory.Start(ctx.Done())
+	}
+	runner.Start(ctx, cron.ExpiryJob(provisioner, hub))
+	runner.Start(ctx, cron.ExpiryNoticeJob(hub))
+
+	f := flamego.Classic()
+	f.Use(flamego.Renderer())
+	f.MapTo(provisioner, (*orchestrator.Provisioner)(nil))
+	f.Map(runner)
+	f.Map(hub)
+
+	f.Use(context.Contexter(database))
+
+	f.Get("/health", route.Health)
+	f.Group("/api", func() {
+		f.Group("/env/{uid}", func() {
+			f.Combo("").
+				Get(route.CreatePod).
+				Delete(route.DeletePod)
+			f.Put("/renew", route.RenewPod)
+			f.Get("/events", route.PodEvents)
+		}, route.UserAuther, route.Enver)
+
+		f.Group("/admin", func() {
+			f.Post("/users", route.RequireScope(db.AdminScopeUsersWrite), route.ImportUsers)
+			f.Get("/pods", route.RequireScope(db.AdminScopePodsRead), route.ListPods)
+			f.Post("/flags/lookup", route.RequireScope(db.AdminScopePodsRead), route.LookupFlag)
+			f.Get("/audit-logs", route.RequireScope(db.AdminScopeAuditRead), route.ListAuditLogs)
+			f.Get("/jobs", route.RequireScope(db.AdminScopeJobsRead), route.ListJobs)
+
+			f.Group("/images", func() {
+				f.Combo("").
+					Get(route.RequireScope(db.AdminScopeImagesRead), route.ListImages).
+					Post(route.RequireScope(db.AdminScopeImagesWrite), route.CreateImage)
+				f.Combo("/{uid}", route.Imager).
+					Get(route.RequireScope(db.AdminScopeImagesRead), route.GetImage).
+					Put(route.RequireScope(db.AdminScopeImagesWrite), route.UpdateImage).
+					Delete(route.RequireScope(db.AdminScopeImagesWrite), route.DeleteImage)
+			})
+		}, route.AdminAuther)
+	})
+
+	go func() {
+		<-ctx.Done()
+		log.Info("Shutting down...")
+		hub.Close()
+		f.Stop()
+	}()
+	host, port, _ := net.SplitHostPort(conf.Server.Addr)
+	portNum, _ := strconv.Atoi(port)
+	f.Run(host, portNum)
+
+	runner.Wait()
+}
+
+func newKubernetesClient() *kubernetes.Clientset {
+	kubeConfig, err := kubeutil.NewConfig(conf.Kubernetes.Kubeconfig, conf.Kubernetes.InsecureSkipTLSVerify)
+	if err != nil {
+		log.Fatal("Failed to get k8s config: %v", err)
+	}
+	if conf.Kubernetes.InsecureSkipTLSVerify {
+		log.Warn("The certificate of the Kubernetes API server is not verified")
+	}
+	k8sClient, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		log.Fatal("Failed to get k8s client: %v", err)
+	}
+	return k8sClient
+}
@@ -0,0 +1,395 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package conf
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The settings, loaded by Init.
+var (
+	Server     ServerOptions
+	Database   DatabaseOptions
+	Kubernetes KubernetesOptions
+	Naming     NamingOptions
+	Auth       AuthOptions
+	Security   SecurityOptions
+	Instance   InstanceOptions
+	Resources  ResourcesOptions
+	Jobs       JobsOptions
+	Dev        DevOptions
+)
+
+// ServerOptions contains the settings of the HTTP server.
+type ServerOptions struct {
+	// Addr is the address to listen on.
+	Addr string `yaml:"addr" env:"OBLIVION_SERVER_ADDR"`
+}
+
+// DatabaseOptions contains the settings of the database.
+type DatabaseOptions struct {
+	// Type is the type of the database, "postgres" or "sqlite".
+	Type string `yaml:"type" env:"OBLIVION_DATABASE_TYPE"`
+
+	Host     string `yaml:"host" env:"POSTGRES_HOST"`
+	Port     int    `yaml:"port" env:"POSTGRES_PORT"`
+	User     string `yaml:"user" env:"POSTGRES_USER"`
+	Password string `yaml:"password" env:"POSTGRES_PASSWORD"`
+	Name     string `yaml:"name" env:"POSTGRES_DB"`
+	SSLMode  string `yaml:"sslmode" env:"POSTGRES_SSLMODE"`
+
+	// Path is the path to the SQLite database file.
+	Path string `yaml:"path" env:"OBLIVION_DATABASE_PATH"`
+}
+
+// KubernetesOptions contains the settings to access the Kubernetes API server.
+type KubernetesOptions struct {
+	// Kubeconfig is the path to the kubeconfig file, the KUBECONFIG
+	// environment variable or the in-cluster service account is used if
+	// empty.
+	Kubeconfig string `yaml:"kubeconfig"`
+	// InsecureSkipTLSVerify skips verifying the certificate of the API
+	// server.
+	InsecureSkipTLSVerify bool `yaml:"insecure_skip_tls_verify" env:"OBLIVION_KUBE_INSECURE_SKIP_TLS_VERIFY"`
+	// ExposeServiceType is the type of the services exposing the TCP and UDP
+	// ports of the instances, "NodePort" or "LoadBalancer".
+	ExposeServiceType string `yaml:"expose_service_type" env:"OBLIVION_KUBE_EXPOSE_SERVICE_TYPE"`
+	// NodeHost is the hostname the players reach the node ports at, the
+	// hostname of the instance is used if empty.
+	NodeHost string `yaml:"node_host" env:"OBLIVION_KUBE_NODE_HOST"`
+}
+
+// NamingOptions contains the settings of the cluster resource names.
+type NamingOptions struct {
+	// Prefix is the prefix of the names of the instance resources.
+	Prefix string `yaml:"prefix" env:"OBLIVION_NAMING_PREFIX"`
+}
+
+// AuthOptions contains the settings of the player authentication.
+type AuthOptions struct {
+	// CookieName is the name of the cookie carrying the player token.
+	CookieName string `yaml:"cookie_name" env:"OBLIVION_AUTH_COOKIE_NAME"`
+	// EnableQueryToken allows passing the player token with the deprecated
+	// "?token=" query parameter, which leaks into access logs and Referer
+	// headers.
+	EnableQueryToken bool `yaml:"enable_query_token" env:"OBLIVION_AUTH_ENABLE_QUERY_TOKEN"`
+}
+
+// SecurityOptions contains the security settings.
+type SecurityOptions struct {
+	// TokenPepper is the server-side secret used to hash the player tokens.
+	// Changing it invalidates all the existing tokens.
+	TokenPepper string `yaml:"token_pepper" env:"OBLIVION_TOKEN_PEPPER"`
+	// FlagSecret is the server-side secret the flags of the instances are
+	// derived from, TokenPepper is used if empty. Changing it only affects the
+	// instances created afterwards.
+	FlagSecret string `yaml:"flag_secret" env:"OBLIVION_FLAG_SECRET"`
+}
+
+// InstanceOptions contains the default lifetime settings of the instances,
+// which can be overridden per image.
+type InstanceOptions struct {
+	// DefaultTTL is the lifetime of a new instance, and how much a renewal
+	// extends it.
+	DefaultTTL time.Duration `yaml:"default_ttl" env:"OBLIVION_INSTANCE_DEFAULT_TTL"`
+	// MaxRenewals is the maximum number of times an instance can be renewed.
+	MaxRenewals int `yaml:"max_renewals" env:"OBLIVION_INSTANCE_MAX_RENEWALS"`
+	// RenewWindow is the remaining time under which an instance can be
+	// renewed.
+	RenewWindow time.Duration `yaml:"renew_window" env:"OBLIVION_INSTANCE_RENEW_WINDOW"`
+}
+
+// ResourcesOptions contains the compute resource settings of the instances,
+// the quantities are in the Kubernetes format such as "500m" or "512Mi".
+type ResourcesOptions struct {
+	// DefaultLimitsCPU, DefaultLimitsMemory, DefaultRequestsCPU and
+	// DefaultRequestsMemory are used when the limitation of an image leaves
+	// them empty.
+	DefaultLimitsCPU      string `yaml:"default_limits_cpu" env:"OBLIVION_RESOURCES_DEFAULT_LIMITS_CPU"`
+	DefaultLimitsMemory   string `yaml:"default_limits_memory" env:"OBLIVION_RESOURCES_DEFAULT_LIMITS_MEMORY"`
+	DefaultRequestsCPU    string `yaml:"default_requests_cpu" env:"OBLIVION_RESOURCES_DEFAULT_REQUESTS_CPU"`
+	DefaultRequestsMemory string `yaml:"default_requests_memory" env:"OBLIVION_RESOURCES_DEFAULT_REQUESTS_MEMORY"`
+	// MaxCPU and MaxMemory are the maximum limits an image can have.
+	MaxCPU    string `yaml:"max_cpu" env:"OBLIVION_RESOURCES_MAX_CPU"`
+	MaxMemory string `yaml:"max_memory" env:"OBLIVION_RESOURCES_MAX_MEMORY"`
+}
+
+// JobsOptions contains the settings of the background jobs.
+type JobsOptions struct {
+	// ExpiryMaxWait caps how long the expiry job sleeps until the next
+	// known expiry.
+	ExpiryMaxWait time.Duration `yaml:"expiry_max_wait" env:"OBLIVION_JOBS_EXPIRY_MAX_WAIT"`
+	// ExpiryNoticeInterval is the interval of the expiring soon notices.
+	ExpiryNoticeInterval time.Duration `yaml:"expiry_notice_interval" env:"OBLIVION_JOBS_EXPIRY_NOTICE_INTERVAL"`
+	// ExpiringSoonWindow is how long before the expiry the players are told
+	// their instances are expiring soon.
+	ExpiringSoonWindow time.Duration `yaml:"expiring_soon_window" env:"OBLIVION_JOBS_EXPIRING_SOON_WINDOW"`
+	// ReconcileInterval is the interval of the reconciliation between the
+	// database and the cluster.
+	ReconcileInterval time.Duration `yaml:"reconcile_interval" env:"OBLIVION_JOBS_RECONCILE_INTERVAL"`
+	// ReconcileGracePeriod is how old an instance or a resource must be
+	// before the reconciler touches it.
+	ReconcileGracePeriod time.Duration `yaml:"reconcile_grace_period" env:"OBLIVION_JOBS_RECONCILE_GRACE_PERIOD"`
+}
+
+// DevOptions contains the settings of the development mode, which runs the
+// instances in memory instead of a cluster.
+type DevOptions struct {
+	// Enabled is set by the "--dev" flag.
+	Enabled bool `yaml:"-"`
+	// ReadyDelay is how long a simulated instance takes to become ready.
+	ReadyDelay time.Duration `yaml:"ready_delay" env:"OBLIVION_DEV_READY_DELAY"`
+	// FailureRate is the probability for a simulated instance to fail to
+	// start.
+	FailureRate float64 `yaml:"failure_rate" env:"OBLIVION_DEV_FAILURE_RATE"`
+	// ErrorRate is the probability for provisioning an instance to fail.
+	ErrorRate float64 `yaml:"error_rate" env:"OBLIVION_DEV_ERROR_RATE"`
+}
+
+// config is the layout of the config file.
+type config struct {
+	Server     *ServerOptions     `yaml:"server"`
+	Database   *DatabaseOptions   `yaml:"database"`
+	Kubernetes *KubernetesOptions `yaml:"kubernetes"`
+	Naming     *NamingOptions     `yaml:"naming"`
+	Auth       *AuthOptions       `yaml:"auth"`
+	Security   *SecurityOptions   `yaml:"security"`
+	Instance   *InstanceOptions   `yaml:"instance"`
+	Resources  *ResourcesOptions  `yaml:"resources"`
+	Jobs       *JobsOptions       `yaml:"jobs"`
+	Dev        *DevOptions        `yaml:"dev"`
+}
+
+// sections returns the layout of the config file pointing to the settings, so
+// decoding into it sets the settings in place.
+func sections() *config {
+	return &config{
+		Server:     &Server,
+		Database:   &Database,
+		Kubernetes: &Kubernetes,
+		Naming:     &Naming,
+		Auth:       &Auth,
+		Security:   &Security,
+		Instance:   &Instance,
+		Resources:  &Resources,
+		Jobs:       &Jobs,
+		Dev:        &Dev,
+	}
+}
+
+// Init loads the configuration from the defaults, the given YAML config file
+// if not empty, and then the environment variables, and validates it. The
+// development mode defaults to a local SQLite database and needs no secret.
+func Init(path string, dev bool) error {
+	setDefaults()
+	if dev {
+		setDevDefaults()
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "read config file")
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(sections()); err != nil && err != io.EOF {
+			return errors.Wrapf(err, "parse config file %q", path)
+		}
+	}
+
+	if err := loadEnv(sections()); err != nil {
+		return err
+	}
+	return validate()
+}
+
+func setDefaults() {
+	Server = ServerOptions{
+		Addr: "0.0.0.0:4000",
+	}
+	Database = DatabaseOptions{
+		Type:    "postgres",
+		Host:    "localhost",
+		Port:    5432,
+		User:    "postgres",
+		Name:    "oblivion",
+		SSLMode: "disable",
+	}
+	Kubernetes = KubernetesOptions{
+		ExposeServiceType: "NodePort",
+	}
+	Naming = NamingOptions{
+		Prefix: "gamebox",
+	}
+	Auth = AuthOptions{
+		CookieName:       "oblivion_token",
+		EnableQueryToken: true,
+	}
+	Security = SecurityOptions{}
+	Instance = InstanceOptions{
+		DefaultTTL:  time.Hour,
+		MaxRenewals: 3,
+		RenewWindow: 15 * time.Minute,
+	}
+	Resources = ResourcesOptions{
+		DefaultLimitsCPU:      "500m",
+		DefaultLimitsMemory:   "512Mi",
+		DefaultRequestsCPU:    "100m",
+		DefaultRequestsMemory: "128Mi",
+		MaxCPU:                "2",
+		MaxMemory:             "2Gi",
+	}
+	Jobs = JobsOptions{
+		ExpiryMaxWait:        30 * time.Second,
+		ExpiryNoticeInterval: 15 * time.Second,
+		ExpiringSoonWindow:   5 * time.Minute,
+		ReconcileInterval:    time.Minute,
+		ReconcileGracePeriod: 2 * time.Minute,
+	}
+	Dev = DevOptions{
+		ReadyDelay: 5 * time.Second,
+	}
+}
+
+func setDevDefaults() {
+	Server.Addr = "127.0.0.1:4000"
+	Database.Type = "sqlite"
+	Database.Path = "oblivion-dev.db"
+	Security.TokenPepper = "oblivion-dev"
+	Dev.Enabled = true
+}
+
+func validate() error {
+	var errs validationErrors
+	if _, port, err := net.SplitHostPort(Server.Addr); err != nil {
+		errs.add("server.addr", "%v", err)
+	} else if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		errs.add("server.addr", "port must be between 1 and 65535")
+	}
+
+	switch Database.Type {
+	case "postgres":
+		if Database.Host == "" {
+			errs.add("database.host", "is required")
+		}
+		if Database.Port <= 0 || Database.Port > 65535 {
+			errs.add("database.port", "must be between 1 and 65535")
+		}
+		if Database.Name == "" {
+			errs.add("database.name", "is required")
+		}
+	case "sqlite":
+		if Database.Path == "" {
+			errs.add("database.path", "is required")
+		}
+	default:
+		errs.add("database.type", `must be "postgres" or "sqlite"`)
+	}
+
+	if Kubernetes.ExposeServiceType != "NodePort" && Kubernetes.ExposeServiceType != "LoadBalancer" {
+		errs.add("kubernetes.expose_service_type", `must be "NodePort" or "LoadBalancer"`)
+	}
+
+	if !isDNSLabel(Naming.Prefix) || len(Naming.Prefix) > 16 {
+		errs.add("naming.prefix", "must be a lowercase DNS label starting with a letter, of at most 16 characters")
+	}
+
+	if Security.TokenPepper == "" {
+		errs.add("security.token_pepper", "is required")
+	}
+
+	if Instance.DefaultTTL <= 0 {
+		errs.add("instance.default_ttl", "must be positive")
+	}
+	if Instance.MaxRenewals < 0 {
+		errs.add("instance.max_renewals", "must not be negative")
+	}
+	if Instance.RenewWindow < 0 {
+		errs.add("instance.renew_window", "must not be negative")
+	}
+
+	validateResources(&errs)
+
+	for key, d := range map[string]time.Duration{
+		"jobs.expiry_max_wait":        Jobs.ExpiryMaxWait,
+		"jobs.expiry_notice_interval": Jobs.ExpiryNoticeInterval,
+		"jobs.reconcile_interval":     Jobs.ReconcileInterval,
+	} {
+		if d < time.Second {
+			errs.add(key, "must be at least 1s")
+		}
+	}
+	if Jobs.ExpiringSoonWindow < 0 {
+		errs.add("jobs.expiring_soon_window", "must not be negative")
+	}
+	if Jobs.ReconcileGracePeriod < 0 {
+		errs.add("jobs.reconcile_grace_period", "must not be negative")
+	}
+
+	if Dev.ReadyDelay < 0 {
+		errs.add("dev.ready_delay", "must not be negative")
+	}
+	for key, rate := range map[string]float64{
+		"dev.failure_rate": Dev.FailureRate,
+		"dev.error_rate":   Dev.ErrorRate,
+	} {
+		if rate < 0 || rate > 1 {
+			errs.add(key, "must be between 0 and 1")
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateResources checks the resource quantities can be parsed, and the
+// default requests do not exceed the default limits, which do not exceed the
+// maximums.
+func validateResources(errs *validationErrors) {
+	quantities := make(map[string]resource.Quantity, 6)
+	for _, q := range []struct {
+		key   string
+		value string
+	}{
+		{"resources.default_limits_cpu", Resources.DefaultLimitsCPU},
+		{"resources.default_limits_memory", Resources.DefaultLimitsMemory},
+		{"resources.default_requests_cpu", Resources.DefaultRequestsCPU},
+		{"resources.default_requests_memory", Resources.DefaultRequestsMemory},
+		{"resources.max_cpu", Resources.MaxCPU},
+		{"resources.max_memory", Resources.MaxMemory},
+	} {
+		quantity, err := resource.ParseQuantity(q.value)
+		if err != nil {
+			errs.add(q.key, "invalid quantity %q", q.value)
+			continue
+		}
+		quantities[q.key] = quantity
+	}
+
+	for _, pair := range [][2]string{
+		{"resources.default_requests_cpu", "resources.default_limits_cpu"},
+		{"resources.default_requests_memory", "resources.default_limits_memory"},
+		{"resources.default_limits_cpu", "resources.max_cpu"},
+		{"resources.default_limits_memory", "resources.max_memory"},
+	} {
+		value, ok := quantities[pair[0]]
+		bound, boundOK := quantities[pair[1]]
+		if ok && boundOK && value.Cmp(bound) > 0 {
+			errs.add(pair[0], "must not exceed %s", pair[1])
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package conf
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// loadEnv overrides the fields of the sections with the environment variables
+// named by their "env" tags.
+func loadEnv(sections *config) error {
+	v := reflect.ValueOf(sections).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		section := v.Field(i).Elem()
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			key := field.Tag.Get("env")
+			if key == "" {
+				continue
+			}
+			value, ok := os.LookupEnv(key)
+			if !ok {
+				continue
+			}
+			if err := setValue(section.Field(j), value); err != nil {
+				return errors.Wrapf(err, "parse %s", key)
+			}
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setValue(v reflect.Value, value string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return errors.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// validationErrors is the list of the invalid config values.
+type validationErrors []string
+
+func (errs *validationErrors) add(key, format string, v ...interface{}) {
+	*errs = append(*errs, key+": "+fmt.Sprintf(format, v...))
+}
+
+func (errs validationErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(errs, "\n  ")
+}
+
+// dnsLabelRegexp matches an RFC 1035 label, which is what the names of the
+// services must be.
+var dnsLabelRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+func isDNSLabel(s string) bool {
+	return dnsLabelRegexp.MatchString(s)
+}
@@ -44,6 +44,12 @@ func (c *Context) Success(data ...interface{}) error {
 	return nil
 }
 
+// BindJSON decodes the JSON request body into v.
+func (c *Context) BindJSON(v interface{}) error {
+	defer func() { _ = c.Request().Body().ReadCloser().Close() }()
+	return json.NewDecoder(c.Request().Body().ReadCloser()).Decode(v)
+}
+
 func (c *Context) ServerError() error {
 	return c.Error(http.StatusInternalServerError*100, "Internal server error")
 }
@@ -6,43 +6,84 @@ package cron
 
 import (
 	"context"
-	"fmt"
 	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"github.com/pkg/errors"
 	log "unknwon.dev/clog/v2"
 
+	"github.com/wuhan005/oblivion/internal/conf"
 	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/dbutil"
+	"github.com/wuhan005/oblivion/internal/event"
+	"github.com/wuhan005/oblivion/internal/naming"
+	"github.com/wuhan005/oblivion/internal/orchestrator"
 )
 
-func Start(k8sClient *kubernetes.Clientset) {
-	go start(k8sClient)
+// ExpiryJob returns the job tearing down the expired instances, it runs again
+// right at the next expiry time.
+func ExpiryJob(provisioner orchestrator.Provisioner, hub *event.Hub) Job {
+	e := &expirer{
+		provisioner: provisioner,
+		hub:         hub,
+		now:         dbutil.Now,
+	}
+	return Job{
+		Name:     "expiry",
+		Interval: conf.Jobs.ExpiryMaxWait,
+		Run:      e.expire,
+		Next:     e.nextWait,
+	}
+}
+
+// expirer tears down the expired instances at their expiry time.
+type expirer struct {
+	provisioner orchestrator.Provisioner
+	hub         *event.Hub
+	now         dbutil.Clock
+	lastRun     time.Time
 }
 
-func start(k8sClient *kubernetes.Clientset) {
-	ctx := context.Background()
+// expire tears down all the pods expired by now.
+func (e *expirer) expire(ctx context.Context) error {
+	e.lastRun = e.now()
+	pods, err := db.Pods.GetExpired(ctx, e.lastRun)
+	if err != nil {
+		return errors.Wrap(err, "get expired pods")
+	}
 
-	for {
-		pods, err := db.Pods.GetExpired(ctx)
-		if err != nil {
-			log.Error("Failed to get expired pods: %v", err)
+	for _, pod := range pods {
+		if err := orchestrator.TeardownPod(ctx, e.provisioner, pod); err != nil {
+			log.Error("Failed to teardown expired pod %d: %v", pod.ID, err)
 			continue
 		}
+		e.hub.Publish(naming.Namespace(pod.Image.UID, pod.User.Domain), event.Event{
+			Type:      event.TypeExpired,
+			ExpiredAt: &pod.ExpiredAt,
+		})
+		log.Trace("Teardown expired pod %d of user %d, %v after its expiry", pod.ID, pod.UserID, e.now().Sub(pod.ExpiredAt))
+	}
+	return nil
+}
 
-		for _, pod := range pods {
-			namespace := fmt.Sprintf("%s-%s", pod.Image.UID, pod.User.Domain)
-
-			// Delete pods in cluster.
-			if err := k8sClient.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
-				log.Error("Failed to automatically delete pod in cluster: %v", err)
-			}
-
-			if err := db.Pods.Delete(ctx, pod.ID); err != nil {
-				log.Error("Failed to automatically delete pod: %v", err)
-			}
-			log.Trace("Delete expired pod, namespace: %v", namespace)
+// nextWait returns how long to wait until the next pod expiring after the last
+// run expires. It is bounded by the max wait so the instances created in the
+// meantime with an earlier expiry are still torn down in time, and the pods
+// failed to be torn down in the last run are retried after the max wait.
+func (e *expirer) nextWait(ctx context.Context) time.Duration {
+	next, err := db.Pods.GetNextExpiredAt(ctx, e.lastRun)
+	if err != nil {
+		if !errors.Is(err, db.ErrPodsNotFound) {
+			log.Error("Failed to get next expiry time: %v", err)
 		}
-		time.Sleep(5 * time.Second)
+		return conf.Jobs.ExpiryMaxWait
+	}
+
+	wait := next.Sub(e.now())
+	if wait < 0 {
+		return 0
+	}
+	if wait > conf.Jobs.ExpiryMaxWait {
+		return conf.Jobs.ExpiryMaxWait
 	}
+	return wait
 }
@@ -0,0 +1,252 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cron
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/conf"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/event"
+	"github.com/wuhan005/oblivion/internal/orchestrator"
+)
+
+func TestMain(m *testing.M) {
+	if err := log.NewConsole(log.ConsoleConfig{Level: log.LevelError}); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	log.Stop()
+	os.Exit(code)
+}
+
+// initTestDB initializes the stores with a fresh SQLite database.
+func initTestDB(t *testing.T) {
+	t.Helper()
+
+	conf.Database.Type = "sqlite"
+	conf.Database.Path = filepath.Join(t.TempDir(), "oblivion.db")
+	if _, err := db.Init(); err != nil {
+		t.Fatalf("Failed to init database: %v", err)
+	}
+}
+
+// teardownRecorder is a Provisioner recording the torn down namespaces.
+type teardownRecorder struct {
+	mu         sync.Mutex
+	namespaces []string
+}
+
+func (p *teardownRecorder) Provision(context.Context, orchestrator.Instance) error {
+	return nil
+}
+
+func (p *teardownRecorder) Teardown(_ context.Context, namespace string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.namespaces = append(p.namespaces, namespace)
+	return nil
+}
+
+func (p *teardownRecorder) Status(context.Context, string) (*orchestrator.Status, error) {
+	return &orchestrator.Status{}, nil
+}
+
+func (p *teardownRecorder) Endpoints(context.Context, orchestrator.Instance) ([]orchestrator.Endpoint, error) {
+	return nil, nil
+}
+
+// fakeClock is a clock only moved by the test.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// createProvisioningTestPod creates a pod being provisioned of a new user and
+// image expiring at the given time.
+func createProvisioningTestPod(t *testing.T, name string, expiredAt time.Time) *db.Pod {
+	t.Helper()
+	ctx := context.Background()
+
+	users, err := db.Users.BatchCreate(ctx, db.BatchCreateOptions{Generate: 1})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	image, err := db.Images.Create(ctx, db.CreateImageOptions{
+		Name:   name,
+		Domain: name + ".test",
+		Ports:  []db.ImagePort{{Port: 80, Protocol: db.ImagePortProtocolHTTP}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	pod, err := db.Pods.Create(ctx, db.CreatePodOptions{
+		UserID:    users[0].ID,
+		ImageID:   image.ID,
+		Name:      name,
+		ExpiredAt: expiredAt,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pod: %v", err)
+	}
+	return pod
+}
+
+// createTestPod creates a provisioned pod of a new user and image expiring at
+// the given time.
+func createTestPod(t *testing.T, name string, expiredAt time.Time) *db.Pod {
+	t.Helper()
+
+	pod := createProvisioningTestPod(t, name, expiredAt)
+	if err := db.Pods.SetProvisioned(context.Background(), pod.ID); err != nil {
+		t.Fatalf("Failed to set pod provisioned: %v", err)
+	}
+	return pod
+}
+
+func podExists(t *testing.T, id uint) bool {
+	t.Helper()
+
+	_, err := db.Pods.GetByID(context.Background(), id)
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, db.ErrPodsNotFound) {
+		t.Fatalf("Failed to get pod: %v", err)
+	}
+	return false
+}
+
+func TestExpirer_Bound(t *testing.T) {
+	initTestDB(t)
+	conf.Jobs.ExpiryMaxWait = 30 * time.Second
+
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	provisioner := &teardownRecorder{}
+	e := &expirer{
+		provisioner: provisioner,
+		hub:         event.NewHub(),
+		now:         clock.Now,
+	}
+	ctx := context.Background()
+
+	// One pod expires beyond the max wait, the other is created after the
+	// first run with an earlier expiry, which the scheduled wait does not
+	// know about.
+	late := createTestPod(t, "late", clock.now.Add(95*time.Second))
+	var early *db.Pod
+
+	deadlines := map[uint]time.Time{
+		late.ID: late.ExpiredAt.Add(conf.Jobs.ExpiryMaxWait),
+	}
+	for i := 0; i < 100 && len(deadlines) != 0; i++ {
+		if err := e.expire(ctx); err != nil {
+			t.Fatalf("Failed to expire: %v", err)
+		}
+		for id, deadline := range deadlines {
+			if podExists(t, id) {
+				if clock.now.After(deadline) {
+					t.Fatalf("Pod %d is still alive at %v, %v after its deadline", id, clock.now, clock.now.Sub(deadline))
+				}
+				continue
+			}
+			delete(deadlines, id)
+		}
+
+		if early == nil {
+			early = createTestPod(t, "early", clock.now.Add(10*time.Second))
+			deadlines[early.ID] = early.ExpiredAt.Add(conf.Jobs.ExpiryMaxWait)
+		}
+
+		wait := e.nextWait(ctx)
+		if wait < 0 || wait > conf.Jobs.ExpiryMaxWait {
+			t.Fatalf("Wait %v is out of [0, %v]", wait, conf.Jobs.ExpiryMaxWait)
+		}
+		if wait == 0 {
+			// Avoid spinning on a pod failed to be torn down.
+			wait = time.Second
+		}
+		clock.now = clock.now.Add(wait)
+	}
+	if len(deadlines) != 0 {
+		t.Fatalf("Pods %v are never torn down", deadlines)
+	}
+	if got := len(provisioner.namespaces); got != 2 {
+		t.Fatalf("Want 2 torn down namespaces, got %d", got)
+	}
+}
+
+func TestExpirer_NextWait(t *testing.T) {
+	initTestDB(t)
+	conf.Jobs.ExpiryMaxWait = 30 * time.Second
+
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	e := &expirer{
+		provisioner: &teardownRecorder{},
+		hub:         event.NewHub(),
+		now:         clock.Now,
+	}
+	ctx := context.Background()
+
+	if err := e.expire(ctx); err != nil {
+		t.Fatalf("Failed to expire: %v", err)
+	}
+	if got := e.nextWait(ctx); got != conf.Jobs.ExpiryMaxWait {
+		t.Fatalf("Want the max wait %v without any pod, got %v", conf.Jobs.ExpiryMaxWait, got)
+	}
+
+	createTestPod(t, "far", clock.now.Add(time.Hour))
+	if got := e.nextWait(ctx); got != conf.Jobs.ExpiryMaxWait {
+		t.Fatalf("Want the max wait %v, got %v", conf.Jobs.ExpiryMaxWait, got)
+	}
+
+	createTestPod(t, "near", clock.now.Add(12*time.Second+345*time.Millisecond))
+	clock.now = clock.now.Add(2 * time.Second)
+	if got, want := e.nextWait(ctx), 10*time.Second+345*time.Millisecond; got != want {
+		t.Fatalf("Want the exact remaining %v, got %v", want, got)
+	}
+}
+
+func TestExpirer_Provisioning(t *testing.T) {
+	initTestDB(t)
+	conf.Jobs.ReconcileGracePeriod = time.Hour
+
+	clock := &fakeClock{now: time.Now()}
+	provisioner := &teardownRecorder{}
+	e := &expirer{
+		provisioner: provisioner,
+		hub:         event.NewHub(),
+		now:         clock.Now,
+	}
+	ctx := context.Background()
+
+	pod := createProvisioningTestPod(t, "provisioning", clock.now.Add(-time.Second))
+	if err := e.expire(ctx); err != nil {
+		t.Fatalf("Failed to expire: %v", err)
+	}
+	if !podExists(t, pod.ID) {
+		t.Fatal("Pod being provisioned is torn down")
+	}
+
+	// The provisioning has been interrupted once the grace period passes.
+	conf.Jobs.ReconcileGracePeriod = 0
+	if err := e.expire(ctx); err != nil {
+		t.Fatalf("Failed to expire: %v", err)
+	}
+	if podExists(t, pod.ID) {
+		t.Fatal("Pod whose provisioning was interrupted is never torn down")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cron
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/wuhan005/oblivion/internal/conf"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/dbutil"
+	"github.com/wuhan005/oblivion/internal/event"
+	"github.com/wuhan005/oblivion/internal/naming"
+)
+
+// ExpiryNoticeJob returns the job publishing the expiring soon events of the
+// instances. An instance is noticed again once it is renewed.
+func ExpiryNoticeJob(hub *event.Hub) Job {
+	n := &noticer{
+		hub:     hub,
+		now:     dbutil.Now,
+		noticed: map[uint]time.Time{},
+	}
+	return Job{
+		Name:     "expiry-notice",
+		Interval: conf.Jobs.ExpiryNoticeInterval,
+		Run:      n.notice,
+	}
+}
+
+type noticer struct {
+	hub *event.Hub
+	now dbutil.Clock
+	// noticed is the expiry time of the pods which have been noticed.
+	noticed map[uint]time.Time
+}
+
+func (n *noticer) notice(ctx context.Context) error {
+	now := n.now()
+	pods, err := db.Pods.GetExpired(ctx, now.Add(conf.Jobs.ExpiringSoonWindow))
+	if err != nil {
+		return errors.Wrap(err, "get expiring pods")
+	}
+
+	noticed := make(map[uint]time.Time, len(pods))
+	for _, pod := range pods {
+		if !pod.ExpiredAt.After(now) {
+			continue
+		}
+		noticed[pod.ID] = pod.ExpiredAt
+		if n.noticed[pod.ID].Equal(pod.ExpiredAt) {
+			continue
+		}
+
+		expiredAt := pod.ExpiredAt
+		n.hub.Publish(naming.Namespace(pod.Image.UID, pod.User.Domain), event.Event{
+			Type:      event.TypeExpiringSoon,
+			ExpiredAt: &expiredAt,
+		})
+	}
+	n.noticed = noticed
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cron
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/conf"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/event"
+	"github.com/wuhan005/oblivion/internal/naming"
+	"github.com/wuhan005/oblivion/internal/orchestrator"
+)
+
+// Reconciler compares the pods table with the oblivion-labelled resources in
+// the cluster. It garbage-collects the namespaces without a database record,
+// and releases the database records any of whose pods has vanished or been
+// evicted, or whose provisioning never finished, so the next request
+// provisions a fresh instance.
+type Reconciler struct {
+	provisioner orchestrator.Provisioner
+	namespaces  corelisters.NamespaceLister
+	pods        corelisters.PodLister
+	services    corelisters.ServiceLister
+	ingresses   networkinglisters.IngressLister
+	synced      []cache.InformerSynced
+	hub         *event.Hub
+}
+
+// NewReconciler returns a Reconciler watching the oblivion-labelled resources
+// with the informers of the given factory.
+func NewReconciler(provisioner orchestrator.Provisioner, factory informers.SharedInformerFactory, hub *event.Hub) *Reconciler {
+	namespaces := factory.Core().V1().Namespaces()
+	pods := factory.Core().V1().Pods()
+	services := factory.Core().V1().Services()
+	ingresses := factory.Networking().V1().Ingresses()
+
+	return &Reconciler{
+		provisioner: provisioner,
+		namespaces:  namespaces.Lister(),
+		pods:        pods.Lister(),
+		services:    services.Lister(),
+		ingresses:   ingresses.Lister(),
+		synced: []cache.InformerSynced{
+			namespaces.Informer().HasSynced,
+			pods.Informer().HasSynced,
+			services.Informer().HasSynced,
+			ingresses.Informer().HasSynced,
+		},
+		hub: hub,
+	}
+}
+
+// ReconcileJob returns the job reconciling the oblivion-labelled resources
+// watched by the shared informer factory with the pods table. It must be
+// called before the factory is started.
+func ReconcileJob(provisioner orchestrator.Provisioner, factory informers.SharedInformerFactory, hub *event.Hub) Job {
+	reconciler := NewReconciler(provisioner, factory, hub)
+
+	return Job{
+		Name:     "reconcile",
+		Interval: conf.Jobs.ReconcileInterval,
+		Jitter:   conf.Jobs.ReconcileInterval / 6,
+		Run: func(ctx context.Context) error {
+			if !cache.WaitForCacheSync(ctx.Done(), reconciler.synced...) {
+				return errors.New("informers not synced")
+			}
+			return reconciler.Reconcile(ctx)
+		},
+	}
+}
+
+// Reconcile runs a single reconciliation pass.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	pods, err := db.Pods.Get(ctx, db.GetPodsOptions{})
+	if err != nil {
+		return errors.Wrap(err, "get pods")
+	}
+
+	// The instances and the resources younger than the grace period are left
+	// alone as they may be being created.
+	gracePeriod := conf.Jobs.ReconcileGracePeriod
+	now := time.Now()
+	instances := make(map[string]*db.Pod, len(pods))
+	for _, pod := range pods {
+		instances[naming.Namespace(pod.Image.UID, pod.User.Domain)] = pod
+	}
+
+	// Collect the namespaces of the labelled resources without an instance.
+	orphans := map[string]struct{}{}
+	markOrphan := func(meta metav1.Object) {
+		if _, ok := instances[meta.GetNamespace()]; ok {
+			return
+		}
+		if meta.GetDeletionTimestamp() != nil || now.Sub(meta.GetCreationTimestamp().Time) < gracePeriod {
+			return
+		}
+		orphans[meta.GetNamespace()] = struct{}{}
+	}
+
+	namespaces, err := r.namespaces.List(labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "list namespaces")
+	}
+	for _, namespace := range namespaces {
+		if _, ok := instances[namespace.Name]; ok {
+			continue
+		}
+		if namespace.DeletionTimestamp != nil || now.Sub(namespace.CreationTimestamp.Time) < gracePeriod {
+			continue
+		}
+		orphans[namespace.Name] = struct{}{}
+	}
+
+	services, err := r.services.List(labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "list services")
+	}
+	for _, service := range services {
+		markOrphan(service)
+	}
+
+	ingresses, err := r.ingresses.List(labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "list ingresses")
+	}
+	for _, ingress := range ingresses {
+		markOrphan(ingress)
+	}
+
+	clusterPods, err := r.pods.List(labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "list pods")
+	}
+	alive := map[string]int{}
+	for _, pod := range clusterPods {
+		markOrphan(pod)
+		if pod.DeletionTimestamp == nil && pod.Status.Phase != v1.PodFailed && pod.Status.Phase != v1.PodSucceeded {
+			alive[pod.Namespace]++
+		}
+	}
+
+	var collected, failed int
+	for namespace := range orphans {
+		if err := r.provisioner.Teardown(ctx, namespace); err != nil {
+			log.Error("Failed to garbage-collect namespace %q: %v", namespace, err)
+			failed++
+			continue
+		}
+		collected++
+	}
+
+	// Release the instances any of whose pods has vanished or been evicted, or
+	// whose provisioning never finished.
+	var released int
+	for namespace, pod := range instances {
+		if now.Sub(pod.CreatedAt) < gracePeriod {
+			continue
+		}
+		// A pod still being provisioned after the grace period has had its
+		// provisioning interrupted, and its resources may be incomplete.
+		if pod.State == db.PodStateProvisioning {
+			if err := orchestrator.TeardownPod(ctx, r.provisioner, pod); err != nil {
+				log.Error("Failed to release pod %d whose provisioning was interrupted: %v", pod.ID, err)
+				failed++
+				continue
+			}
+			r.hub.Publish(namespace, event.Event{Type: event.TypeDeleted})
+			released++
+			continue
+		}
+
+		// The image may have been changed since the instance was provisioned,
+		// only the pods recorded by the previous versions fall back to its
+		// current containers.
+		expected := pod.Containers
+		if expected == 0 {
+			containers, err := pod.Image.GetContainers()
+			if err != nil {
+				log.Error("Failed to get containers of pod %d: %v", pod.ID, err)
+				failed++
+				continue
+			}
+			expected = len(containers)
+		}
+		if alive[namespace] >= expected {
+			continue
+		}
+		if err := orchestrator.TeardownPod(ctx, r.provisioner, pod); err != nil {
+			log.Error("Failed to release pod %d whose cluster pod vanished: %v", pod.ID, err)
+			failed++
+			continue
+		}
+		r.hub.Publish(namespace, event.Event{Type: event.TypeDeleted})
+		released++
+	}
+
+	log.Info("Reconciled %d instances with %d cluster pods: %d orphaned namespaces collected, %d lost instances released, %d failures",
+		len(instances), len(clusterPods), collected, released, failed)
+	return nil
+}
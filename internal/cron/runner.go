@@ -0,0 +1,176 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cron
+
+import (
+	"context"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+)
+
+// maxErrorBackoff caps the delay before retrying a failing job.
+const maxErrorBackoff = 10 * time.Minute
+
+// Job is a background job run periodically by the Runner.
+type Job struct {
+	Name string
+	// Interval is the delay between two runs.
+	Interval time.Duration
+	// Jitter is the maximum random delay added to every run.
+	Jitter time.Duration
+	// Run runs the job once.
+	Run func(ctx context.Context) error
+	// Next optionally returns the delay before the next run after a successful
+	// run, it is capped by Interval.
+	Next func(ctx context.Context) time.Duration
+}
+
+// JobStatus is the status of a job.
+type JobStatus struct {
+	Name                string
+	Running             bool
+	LastRunAt           time.Time
+	LastSuccessAt       time.Time
+	LastError           string `json:",omitempty"`
+	ConsecutiveFailures int
+	NextRunAt           time.Time
+}
+
+// Runner runs the background jobs until its context is cancelled. Every job
+// runs in its own goroutine, a panicking job is recovered and a failing job is
+// retried with an exponential backoff.
+type Runner struct {
+	wg sync.WaitGroup
+
+	mu       sync.RWMutex
+	statuses map[string]*JobStatus
+}
+
+// NewRunner returns a new Runner.
+func NewRunner() *Runner {
+	return &Runner{
+		statuses: map[string]*JobStatus{},
+	}
+}
+
+// Start starts running the given job until the context is cancelled.
+func (r *Runner) Start(ctx context.Context, job Job) {
+	r.mu.Lock()
+	r.statuses[job.Name] = &JobStatus{Name: job.Name}
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.loop(ctx, job)
+	}()
+}
+
+// Wait blocks until all the jobs have stopped.
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+// Statuses returns the statuses of all the jobs sorted by name.
+func (r *Runner) Statuses() []JobStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	statuses := make([]JobStatus, 0, len(r.statuses))
+	for _, status := range r.statuses {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func (r *Runner) loop(ctx context.Context, job Job) {
+	for {
+		r.update(job.Name, func(status *JobStatus) {
+			status.Running = true
+			status.LastRunAt = time.Now()
+		})
+		err := r.runOnce(ctx, job)
+
+		var wait time.Duration
+		r.update(job.Name, func(status *JobStatus) {
+			status.Running = false
+			if err != nil {
+				status.LastError = err.Error()
+				status.ConsecutiveFailures++
+				wait = backoff(job.Interval, status.ConsecutiveFailures)
+				return
+			}
+			status.LastSuccessAt = status.LastRunAt
+			status.LastError = ""
+			status.ConsecutiveFailures = 0
+		})
+		if err != nil {
+			log.Error("Job %q failed: %v", job.Name, err)
+		} else {
+			wait = job.Interval
+			if job.Next != nil {
+				if next := job.Next(ctx); next < wait {
+					wait = next
+				}
+			}
+		}
+		if job.Jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(job.Jitter)))
+		}
+		r.update(job.Name, func(status *JobStatus) {
+			status.NextRunAt = time.Now().Add(wait)
+		})
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Trace("Job %q stopped", job.Name)
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// runOnce runs the job once, recovering from any panic.
+func (r *Runner) runOnce(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			// The stack only goes to the log, the error ends up in the job
+			// status.
+			log.Error("Job %q panicked: %v\n%s", job.Name, recovered, debug.Stack())
+			err = errors.Errorf("panic: %v", recovered)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+func (r *Runner) update(name string, fn func(status *JobStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(r.statuses[name])
+}
+
+// backoff returns the delay before retrying a job after the given number of
+// consecutive failures, doubling the interval on every failure.
+func backoff(interval time.Duration, failures int) time.Duration {
+	wait := interval
+	for i := 1; i < failures && wait < maxErrorBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxErrorBackoff {
+		wait = maxErrorBackoff
+	}
+	return wait
+}
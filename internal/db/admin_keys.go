@@ -0,0 +1,166 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/thanhpk/randstr"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var _ AdminKeysStore = (*adminKeys)(nil)
+
+// AdminKeys is the default instance of the AdminKeysStore.
+var AdminKeys AdminKeysStore
+
+// AdminKeysStore is the persistent interface for admin API keys.
+type AdminKeysStore interface {
+	// Create creates a new admin API key, the plaintext key is only set on the
+	// returned AdminKey.
+	Create(ctx context.Context, opts CreateAdminKeyOptions) (*AdminKey, error)
+	// List returns all the admin API keys.
+	List(ctx context.Context) ([]*AdminKey, error)
+	// GetByKey returns an admin API key by its plaintext key.
+	GetByKey(ctx context.Context, key string) (*AdminKey, error)
+	// Delete deletes an admin API key by its ID. It returns ErrAdminKeyNotFound
+	// if there is no such key.
+	Delete(ctx context.Context, id uint) error
+}
+
+// NewAdminKeysStore returns a AdminKeysStore instance with the given database connection.
+func NewAdminKeysStore(db *gorm.DB) AdminKeysStore {
+	return &adminKeys{DB: db}
+}
+
+// AdminScope is the permission granted to an admin API key.
+type AdminScope string
+
+const (
+	AdminScopeImagesRead  AdminScope = "images:read"
+	AdminScopeImagesWrite AdminScope = "images:write"
+	AdminScopeUsersWrite  AdminScope = "users:write"
+	AdminScopePodsRead    AdminScope = "pods:read"
+	AdminScopeAuditRead   AdminScope = "audit:read"
+	AdminScopeJobsRead    AdminScope = "jobs:read"
+)
+
+// AdminScopes contains all the valid admin scopes.
+var AdminScopes = []AdminScope{
+	AdminScopeImagesRead,
+	AdminScopeImagesWrite,
+	AdminScopeUsersWrite,
+	AdminScopePodsRead,
+	AdminScopeAuditRead,
+	AdminScopeJobsRead,
+}
+
+type AdminKey struct {
+	gorm.Model
+
+	Name    string
+	Key     string         `gorm:"-" json:",omitempty"`
+	KeyHash string         `gorm:"uniqueIndex:admin_key_hash_unique_idx,where:deleted_at IS NULL" json:"-"`
+	Scopes  datatypes.JSON `gorm:"type:jsonb"`
+}
+
+func (k *AdminKey) GetScopes() []AdminScope {
+	var scopes []AdminScope
+	_ = json.Unmarshal(k.Scopes, &scopes)
+	return scopes
+}
+
+// HasScope returns true if the admin API key is granted the given scope.
+func (k *AdminKey) HasScope(scope AdminScope) bool {
+	for _, s := range k.GetScopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type adminKeys struct {
+	*gorm.DB
+}
+
+type CreateAdminKeyOptions struct {
+	Name   string
+	Scopes []AdminScope
+}
+
+var ErrInvalidAdminScope = errors.New("invalid admin scope")
+
+func (db *adminKeys) Create(ctx context.Context, opts CreateAdminKeyOptions) (*AdminKey, error) {
+	for _, scope := range opts.Scopes {
+		if !isValidAdminScope(scope) {
+			return nil, errors.Wrapf(ErrInvalidAdminScope, "%q", scope)
+		}
+	}
+	scopes, _ := json.Marshal(opts.Scopes)
+
+	key := randstr.Hex(32)
+	adminKey := &AdminKey{
+		Name:    opts.Name,
+		KeyHash: hashAdminKey(key),
+		Scopes:  scopes,
+	}
+	if err := db.WithContext(ctx).Create(adminKey).Error; err != nil {
+		return nil, err
+	}
+	adminKey.Key = key
+	return adminKey, nil
+}
+
+func (db *adminKeys) List(ctx context.Context) ([]*AdminKey, error) {
+	var adminKeys []*AdminKey
+	if err := db.WithContext(ctx).Order("id ASC").Find(&adminKeys).Error; err != nil {
+		return nil, err
+	}
+	return adminKeys, nil
+}
+
+var ErrAdminKeyNotFound = errors.New("admin key dose not exist")
+
+func (db *adminKeys) GetByKey(ctx context.Context, key string) (*AdminKey, error) {
+	var adminKey AdminKey
+	if err := db.WithContext(ctx).Where("key_hash = ?", hashAdminKey(key)).First(&adminKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAdminKeyNotFound
+		}
+		return nil, err
+	}
+	return &adminKey, nil
+}
+
+func (db *adminKeys) Delete(ctx context.Context, id uint) error {
+	tx := db.WithContext(ctx).Delete(&AdminKey{}, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrAdminKeyNotFound
+	}
+	return nil
+}
+
+func isValidAdminScope(scope AdminScope) bool {
+	for _, s := range AdminScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAdminKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
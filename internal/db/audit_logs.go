@@ -0,0 +1,84 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+var _ AuditLogsStore = (*auditLogs)(nil)
+
+// AuditLogs is the default instance of the AuditLogsStore.
+var AuditLogs AuditLogsStore
+
+// AuditLogsStore is the persistent interface for admin audit logs.
+type AuditLogsStore interface {
+	// Create records an action performed by an admin API key.
+	Create(ctx context.Context, opts CreateAuditLogOptions) error
+	// List returns the latest audit logs.
+	List(ctx context.Context, opts ListAuditLogsOptions) ([]*AuditLog, error)
+}
+
+// NewAuditLogsStore returns a AuditLogsStore instance with the given database connection.
+func NewAuditLogsStore(db *gorm.DB) AuditLogsStore {
+	return &auditLogs{DB: db}
+}
+
+type AuditLog struct {
+	gorm.Model
+
+	AdminKeyID   uint `gorm:"index"`
+	AdminKeyName string
+	Method       string
+	Path         string
+	StatusCode   int
+	RemoteAddr   string
+}
+
+type auditLogs struct {
+	*gorm.DB
+}
+
+type CreateAuditLogOptions struct {
+	AdminKeyID   uint
+	AdminKeyName string
+	Method       string
+	Path         string
+	StatusCode   int
+	RemoteAddr   string
+}
+
+func (db *auditLogs) Create(ctx context.Context, opts CreateAuditLogOptions) error {
+	return db.WithContext(ctx).Create(&AuditLog{
+		AdminKeyID:   opts.AdminKeyID,
+		AdminKeyName: opts.AdminKeyName,
+		Method:       opts.Method,
+		Path:         opts.Path,
+		StatusCode:   opts.StatusCode,
+		RemoteAddr:   opts.RemoteAddr,
+	}).Error
+}
+
+type ListAuditLogsOptions struct {
+	AdminKeyID uint
+	Limit      int
+}
+
+func (db *auditLogs) List(ctx context.Context, opts ListAuditLogsOptions) ([]*AuditLog, error) {
+	q := db.WithContext(ctx).Model(&AuditLog{}).Where(&AuditLog{
+		AdminKeyID: opts.AdminKeyID,
+	}).Order("id DESC")
+	if opts.Limit > 0 {
+		q = q.Limit(opts.Limit)
+	}
+
+	var auditLogs []*AuditLog
+	if err := q.Find(&auditLogs).Error; err != nil {
+		return nil, err
+	}
+	return auditLogs, nil
+}
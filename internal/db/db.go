@@ -5,22 +5,24 @@
 package db
 
 import (
-	"os"
+	"net"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"github.com/wuhan005/oblivion/internal/conf"
 	"github.com/wuhan005/oblivion/internal/dbutil"
 )
 
-// Init initializes the database.
-func Init() (*gorm.DB, error) {
-	dsn := os.ExpandEnv("postgres://$POSTGRES_USER:$POSTGRES_PASSWORD@$POSTGRES_HOST:$POSTGRES_PORT/$POSTGRES_DB?sslmode=$POSTGRES_SSLMODE")
-
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+// Open opens the database connection.
+func Open() (*gorm.DB, error) {
+	db, err := gorm.Open(dialector(), &gorm.Config{
 		NowFunc: func() time.Time {
 			return dbutil.Now()
 		},
@@ -28,15 +30,43 @@ func Init() (*gorm.DB, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "open connection")
 	}
+	return db, nil
+}
+
+// Init opens the database connection, applies the pending migrations and
+// initializes the stores. It refuses to work with a database migrated by a
+// newer binary.
+func Init() (*gorm.DB, error) {
+	db, err := Open()
+	if err != nil {
+		return nil, err
+	}
 
-	// Migrate databases.
-	if db.AutoMigrate(&Image{}, &Pod{}, &User{}) != nil {
-		return nil, errors.Wrap(err, "auto migrate")
+	if err := MigrateUp(db, 0); err != nil {
+		return nil, errors.Wrap(err, "migrate")
 	}
 
 	Images = NewImagesStore(db)
 	Pods = NewPodsStore(db)
 	Users = NewUsersStore(db)
+	AdminKeys = NewAdminKeysStore(db)
+	AuditLogs = NewAuditLogsStore(db)
 
 	return db, nil
 }
+
+func dialector() gorm.Dialector {
+	if conf.Database.Type == "sqlite" {
+		// Foreign keys are not enforced by SQLite unless asked to.
+		return sqlite.Open(conf.Database.Path + "?_foreign_keys=1")
+	}
+
+	dsn := (&url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(conf.Database.User, conf.Database.Password),
+		Host:     net.JoinHostPort(conf.Database.Host, strconv.Itoa(conf.Database.Port)),
+		Path:     conf.Database.Name,
+		RawQuery: url.Values{"sslmode": {conf.Database.SSLMode}}.Encode(),
+	}).String()
+	return postgres.Open(dsn)
+}
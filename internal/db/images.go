@@ -6,13 +6,23 @@ package db
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
 
+	"github.com/wuhan005/oblivion/internal/conf"
 	"github.com/wuhan005/oblivion/internal/dbutil"
 )
 
@@ -23,7 +33,8 @@ var Images ImagesStore
 
 // ImagesStore is the persistent interface for images.
 type ImagesStore interface {
-	Create(ctx context.Context, opts CreateImageOptions) error
+	Create(ctx context.Context, opts CreateImageOptions) (*Image, error)
+	List(ctx context.Context) ([]*Image, error)
 	GetByID(ctx context.Context, id uint) (*Image, error)
 	GetByUID(ctx context.Context, uid string) (*Image, error)
 	Update(ctx context.Context, id uint, opts UpdateImageOptions) error
@@ -39,18 +50,174 @@ type Image struct {
 	gorm.Model
 
 	UID        string
-	Name       string `uniqueIndex:"image_name_unique_idx, where:deleted_at IS NULL"`
+	Name       string `gorm:"uniqueIndex:image_name_unique_idx,where:deleted_at IS NULL"`
 	Domain     string
-	Port       int32
+	Ports      datatypes.JSON `gorm:"type:jsonb"`
 	Limitation datatypes.JSON `gorm:"type:jsonb"`
+	// Containers is empty for a single-container image, which is described
+	// by the name, the ports and the limitation of the image.
+	Containers datatypes.JSON `gorm:"type:jsonb"`
+
+	// TTL is the lifetime of a new instance, and how much a renewal extends it.
+	TTL time.Duration
+	// MaxLifetime is the maximum total lifetime of an instance, zero means
+	// unlimited.
+	MaxLifetime time.Duration
+	// MaxRenewals is the maximum number of times an instance can be renewed, a
+	// negative value disables renewal.
+	MaxRenewals int
+	// RenewWindow is the remaining time under which an instance can be renewed.
+	RenewWindow time.Duration
+
+	// FlagTemplate is the template of the flags of the instances, in which
+	// FlagPlaceholder is replaced with a value unique to each user. Empty
+	// means the instances are not given a flag.
+	FlagTemplate string
+	// FlagEnv is the name of the environment variable holding the flag in the
+	// entrypoint container of the instances.
+	FlagEnv string
+	// FlagPath is the path of the file holding the flag in the entrypoint
+	// container of the instances.
+	FlagPath string
+}
+
+// MarshalJSON encodes the durations of the image as duration strings such as
+// "1h30m0s", so the image can be sent back unchanged to be updated.
+func (i Image) MarshalJSON() ([]byte, error) {
+	type image Image
+	return json.Marshal(struct {
+		*image
+		TTL         string
+		MaxLifetime string
+		RenewWindow string
+	}{
+		image:       (*image)(&i),
+		TTL:         i.TTL.String(),
+		MaxLifetime: i.MaxLifetime.String(),
+		RenewWindow: i.RenewWindow.String(),
+	})
+}
+
+// GetTTL returns the instance lifetime of the image, or the default one if not
+// set.
+func (i *Image) GetTTL() time.Duration {
+	if i.TTL > 0 {
+		return i.TTL
+	}
+	return conf.Instance.DefaultTTL
+}
+
+// GetMaxRenewals returns the maximum number of renewals of the image, or the
+// default one if not set.
+func (i *Image) GetMaxRenewals() int {
+	if i.MaxRenewals < 0 {
+		return 0
+	}
+	if i.MaxRenewals > 0 {
+		return i.MaxRenewals
+	}
+	return conf.Instance.MaxRenewals
+}
+
+// GetRenewWindow returns the renewal window of the image, or the default one
+// if not set.
+func (i *Image) GetRenewWindow() time.Duration {
+	if i.RenewWindow > 0 {
+		return i.RenewWindow
+	}
+	return conf.Instance.RenewWindow
+}
+
+// GetPorts returns the ports exposed by the instances of the image.
+func (i *Image) GetPorts() ([]ImagePort, error) {
+	var ports []ImagePort
+	if len(i.Ports) == 0 {
+		return ports, nil
+	}
+	if err := json.Unmarshal(i.Ports, &ports); err != nil {
+		return nil, errors.Wrap(err, "unmarshal ports")
+	}
+	return ports, nil
 }
 
-func (i *Image) GetLimitation() *ImageLimitation {
+// ImagePortProtocol is the protocol of an exposed port.
+type ImagePortProtocol string
+
+const (
+	// ImagePortProtocolHTTP is routed by the ingress from the hostname of the
+	// instance.
+	ImagePortProtocolHTTP ImagePortProtocol = "http"
+	// ImagePortProtocolTCP and ImagePortProtocolUDP are exposed on an
+	// external port allocated by the cluster.
+	ImagePortProtocolTCP ImagePortProtocol = "tcp"
+	ImagePortProtocolUDP ImagePortProtocol = "udp"
+)
+
+// ImagePort is a port exposed by the instances of an image.
+type ImagePort struct {
+	Port     int32
+	Protocol ImagePortProtocol
+}
+
+// ErrInvalidPorts is returned when the ports of an image are invalid.
+var ErrInvalidPorts = errors.New("invalid ports")
+
+// ValidatePorts checks the given ports of an image. There must be at least one
+// port, and at most one HTTP port as the hostname of an instance routes to a
+// single port.
+func ValidatePorts(ports []ImagePort) error {
+	if len(ports) == 0 {
+		return errors.Wrap(ErrInvalidPorts, "at least one port is required")
+	}
+	return validatePorts(ports)
+}
+
+// validatePorts checks the given ports of a container, which can be empty.
+func validatePorts(ports []ImagePort) error {
+	seen := make(map[ImagePort]struct{}, len(ports))
+	httpPorts := 0
+	for _, port := range ports {
+		if port.Port <= 0 || port.Port > 65535 {
+			return errors.Wrapf(ErrInvalidPorts, "port %d is not between 1 and 65535", port.Port)
+		}
+		switch port.Protocol {
+		case ImagePortProtocolHTTP:
+			httpPorts++
+		case ImagePortProtocolTCP, ImagePortProtocolUDP:
+		default:
+			return errors.Wrapf(ErrInvalidPorts, "protocol %q of port %d is not one of http, tcp and udp", port.Protocol, port.Port)
+		}
+
+		// HTTP is served over TCP, so it can not share the port with TCP.
+		key := port
+		if key.Protocol == ImagePortProtocolHTTP {
+			key.Protocol = ImagePortProtocolTCP
+		}
+		if _, ok := seen[key]; ok {
+			return errors.Wrapf(ErrInvalidPorts, "port %d/%s is duplicated", port.Port, port.Protocol)
+		}
+		seen[key] = struct{}{}
+	}
+	if httpPorts > 1 {
+		return errors.Wrap(ErrInvalidPorts, "at most one HTTP port is allowed")
+	}
+	return nil
+}
+
+// GetLimitation returns the resource limitation of the image.
+func (i *Image) GetLimitation() (*ImageLimitation, error) {
 	var limitation ImageLimitation
-	_ = json.Unmarshal(i.Limitation, &limitation)
-	return &limitation
+	if len(i.Limitation) == 0 {
+		return &limitation, nil
+	}
+	if err := json.Unmarshal(i.Limitation, &limitation); err != nil {
+		return nil, errors.Wrap(err, "unmarshal limitation")
+	}
+	return &limitation, nil
 }
 
+// ImageLimitation is the compute resources of the instances of an image, in
+// the Kubernetes quantity format. The empty fields fall back to the defaults.
 type ImageLimitation struct {
 	LimitsCPU      string
 	LimitsMemory   string
@@ -58,35 +225,305 @@ type ImageLimitation struct {
 	RequestsMemory string
 }
 
+// ImageResources is the parsed limitation of an image.
+type ImageResources struct {
+	LimitsCPU      resource.Quantity
+	LimitsMemory   resource.Quantity
+	RequestsCPU    resource.Quantity
+	RequestsMemory resource.Quantity
+}
+
+// ErrInvalidLimitation is returned when the limitation of an image is invalid.
+var ErrInvalidLimitation = errors.New("invalid limitation")
+
+// Resources parses the limitation with the empty fields set to the defaults.
+// It returns ErrInvalidLimitation if any quantity is malformed, the requests
+// exceed the limits, or the limits exceed the maximums.
+func (l *ImageLimitation) Resources() (*ImageResources, error) {
+	var resources ImageResources
+	for _, q := range []struct {
+		name         string
+		value        string
+		defaultValue string
+		quantity     *resource.Quantity
+	}{
+		{"LimitsCPU", l.LimitsCPU, conf.Resources.DefaultLimitsCPU, &resources.LimitsCPU},
+		{"LimitsMemory", l.LimitsMemory, conf.Resources.DefaultLimitsMemory, &resources.LimitsMemory},
+		{"RequestsCPU", l.RequestsCPU, conf.Resources.DefaultRequestsCPU, &resources.RequestsCPU},
+		{"RequestsMemory", l.RequestsMemory, conf.Resources.DefaultRequestsMemory, &resources.RequestsMemory},
+	} {
+		value := q.value
+		if value == "" {
+			value = q.defaultValue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidLimitation, "%s: malformed quantity %q", q.name, value)
+		}
+		*q.quantity = quantity
+	}
+
+	if resources.RequestsCPU.Cmp(resources.LimitsCPU) > 0 {
+		return nil, errors.Wrapf(ErrInvalidLimitation, "RequestsCPU %s exceeds LimitsCPU %s", resources.RequestsCPU.String(), resources.LimitsCPU.String())
+	}
+	if resources.RequestsMemory.Cmp(resources.LimitsMemory) > 0 {
+		return nil, errors.Wrapf(ErrInvalidLimitation, "RequestsMemory %s exceeds LimitsMemory %s", resources.RequestsMemory.String(), resources.LimitsMemory.String())
+	}
+	if err := checkMaximums(resources.LimitsCPU, resources.LimitsMemory); err != nil {
+		return nil, err
+	}
+	return &resources, nil
+}
+
+// checkMaximums checks the given limits do not exceed the maximums.
+func checkMaximums(limitsCPU, limitsMemory resource.Quantity) error {
+	maxCPU, err := resource.ParseQuantity(conf.Resources.MaxCPU)
+	if err != nil {
+		return errors.Wrap(err, "parse max CPU")
+	}
+	if limitsCPU.Cmp(maxCPU) > 0 {
+		return errors.Wrapf(ErrInvalidLimitation, "LimitsCPU %s exceeds the maximum %s", limitsCPU.String(), maxCPU.String())
+	}
+	maxMemory, err := resource.ParseQuantity(conf.Resources.MaxMemory)
+	if err != nil {
+		return errors.Wrap(err, "parse max memory")
+	}
+	if limitsMemory.Cmp(maxMemory) > 0 {
+		return errors.Wrapf(ErrInvalidLimitation, "LimitsMemory %s exceeds the maximum %s", limitsMemory.String(), maxMemory.String())
+	}
+	return nil
+}
+
+// GetContainers returns the containers of the image. An image without
+// containers runs a single container of its name, ports and limitation.
+func (i *Image) GetContainers() ([]ImageContainer, error) {
+	if len(i.Containers) != 0 && string(i.Containers) != "null" {
+		var containers []ImageContainer
+		if err := json.Unmarshal(i.Containers, &containers); err != nil {
+			return nil, errors.Wrap(err, "unmarshal containers")
+		}
+		if len(containers) != 0 {
+			return containers, nil
+		}
+	}
+
+	ports, err := i.GetPorts()
+	if err != nil {
+		return nil, err
+	}
+	limitation, err := i.GetLimitation()
+	if err != nil {
+		return nil, err
+	}
+	return []ImageContainer{
+		{
+			Image:      i.Name,
+			Ports:      ports,
+			Limitation: *limitation,
+			Entrypoint: true,
+		},
+	}, nil
+}
+
+// ImageContainer is a container of a multi-container image. Every container
+// runs in its own pod, and the ones with ports are reachable by their names
+// from the other containers of the instance.
+type ImageContainer struct {
+	// Name is the DNS name of the container within the instance. It is empty
+	// for the only container of a single-container image.
+	Name       string
+	Image      string
+	Ports      []ImagePort
+	Env        []ImageEnv
+	Limitation ImageLimitation
+	// Entrypoint is true for the container whose ports are exposed to the
+	// players, the ports of the others are only reachable within the
+	// instance.
+	Entrypoint bool
+}
+
+// ImageEnv is an environment variable of a container.
+type ImageEnv struct {
+	Name  string
+	Value string
+}
+
+// EntrypointContainer returns the entrypoint among the given containers.
+func EntrypointContainer(containers []ImageContainer) (*ImageContainer, error) {
+	for i := range containers {
+		if containers[i].Entrypoint {
+			return &containers[i], nil
+		}
+	}
+	return nil, errors.Wrap(ErrInvalidContainers, "no entrypoint container")
+}
+
+// ErrInvalidContainers is returned when the containers of an image are
+// invalid.
+var ErrInvalidContainers = errors.New("invalid containers")
+
+// ValidateContainers checks the given containers of an image. Exactly one of
+// them must be the entrypoint, and the total of their limits must not exceed
+// the maximums.
+func ValidateContainers(containers []ImageContainer) error {
+	if len(containers) == 0 {
+		return errors.Wrap(ErrInvalidContainers, "at least one container is required")
+	}
+
+	names := make(map[string]struct{}, len(containers))
+	entrypoints := 0
+	var limitsCPU, limitsMemory resource.Quantity
+	for _, container := range containers {
+		if msgs := validation.IsDNS1035Label(container.Name); len(msgs) != 0 {
+			return errors.Wrapf(ErrInvalidContainers, "name %q: %s", container.Name, strings.Join(msgs, ", "))
+		}
+		if _, ok := names[container.Name]; ok {
+			return errors.Wrapf(ErrInvalidContainers, "name %q is duplicated", container.Name)
+		}
+		names[container.Name] = struct{}{}
+
+		if container.Image == "" {
+			return errors.Wrapf(ErrInvalidContainers, "image of container %q is required", container.Name)
+		}
+		if container.Entrypoint {
+			entrypoints++
+			if err := ValidatePorts(container.Ports); err != nil {
+				return errors.Wrapf(err, "container %q", container.Name)
+			}
+		} else if err := validatePorts(container.Ports); err != nil {
+			return errors.Wrapf(err, "container %q", container.Name)
+		}
+		for _, env := range container.Env {
+			if msgs := validation.IsEnvVarName(env.Name); len(msgs) != 0 {
+				return errors.Wrapf(ErrInvalidContainers, "env %q of container %q: %s", env.Name, container.Name, strings.Join(msgs, ", "))
+			}
+		}
+
+		resources, err := container.Limitation.Resources()
+		if err != nil {
+			return errors.Wrapf(err, "container %q", container.Name)
+		}
+		limitsCPU.Add(resources.LimitsCPU)
+		limitsMemory.Add(resources.LimitsMemory)
+	}
+	if entrypoints != 1 {
+		return errors.Wrap(ErrInvalidContainers, "exactly one container must be the entrypoint")
+	}
+	if err := checkMaximums(limitsCPU, limitsMemory); err != nil {
+		return errors.Wrap(err, "total of the containers")
+	}
+	return nil
+}
+
+// FlagPlaceholder is the placeholder of the flag templates replaced with the
+// value unique to each user.
+const FlagPlaceholder = "${hmac}"
+
+// RenderFlag returns the flag of the instance of the given user, or empty if
+// the image has no flag template. The flag is derived from the user, the
+// image and the server-side secret, so it cannot be guessed by other users.
+func (i *Image) RenderFlag(userID uint) string {
+	if i.FlagTemplate == "" {
+		return ""
+	}
+
+	secret := conf.Security.FlagSecret
+	if secret == "" {
+		secret = conf.Security.TokenPepper
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d:%s", userID, i.UID)
+	return strings.ReplaceAll(i.FlagTemplate, FlagPlaceholder, hex.EncodeToString(mac.Sum(nil))[:32])
+}
+
+// ErrInvalidFlag is returned when the flag settings of an image are invalid.
+var ErrInvalidFlag = errors.New("invalid flag")
+
+// ValidateFlag checks the flag template of an image, and the environment
+// variable and the file the flag is injected into.
+func ValidateFlag(template, env, filePath string) error {
+	if template == "" {
+		if env != "" || filePath != "" {
+			return errors.Wrap(ErrInvalidFlag, "template is required to inject the flag")
+		}
+		return nil
+	}
+	if !strings.Contains(template, FlagPlaceholder) {
+		return errors.Wrapf(ErrInvalidFlag, "template must contain %q", FlagPlaceholder)
+	}
+	if env == "" && filePath == "" {
+		return errors.Wrap(ErrInvalidFlag, "env or path is required")
+	}
+	if env != "" {
+		if msgs := validation.IsEnvVarName(env); len(msgs) != 0 {
+			return errors.Wrapf(ErrInvalidFlag, "env %q: %s", env, strings.Join(msgs, ", "))
+		}
+	}
+	if filePath != "" && (!path.IsAbs(filePath) || path.Clean(filePath) != filePath || filePath == "/") {
+		return errors.Wrapf(ErrInvalidFlag, "path %q must be a clean absolute file path", filePath)
+	}
+	return nil
+}
+
 type images struct {
 	*gorm.DB
 }
 
 type CreateImageOptions struct {
-	Name       string
-	Domain     string
-	Port       int32
-	Limitation ImageLimitation
+	Name         string
+	Domain       string
+	Ports        []ImagePort
+	Limitation   ImageLimitation
+	Containers   []ImageContainer
+	TTL          time.Duration
+	MaxLifetime  time.Duration
+	MaxRenewals  int
+	RenewWindow  time.Duration
+	FlagTemplate string
+	FlagEnv      string
+	FlagPath     string
 }
 
 var ErrDuplicateImage = errors.New("duplicate image")
 
-func (db *images) Create(ctx context.Context, opts CreateImageOptions) error {
+func (db *images) Create(ctx context.Context, opts CreateImageOptions) (*Image, error) {
+	ports, _ := json.Marshal(opts.Ports)
 	limitation, _ := json.Marshal(opts.Limitation)
+	var containers []byte
+	if len(opts.Containers) != 0 {
+		containers, _ = json.Marshal(opts.Containers)
+	}
 
-	if err := db.WithContext(ctx).Create(&Image{
-		UID:        uuid.New().String(),
-		Name:       opts.Name,
-		Domain:     opts.Domain,
-		Port:       opts.Port,
-		Limitation: limitation,
-	}).Error; err != nil {
+	image := &Image{
+		UID:          uuid.New().String(),
+		Name:         opts.Name,
+		Domain:       opts.Domain,
+		Ports:        ports,
+		Limitation:   limitation,
+		Containers:   containers,
+		TTL:          opts.TTL,
+		MaxLifetime:  opts.MaxLifetime,
+		MaxRenewals:  opts.MaxRenewals,
+		RenewWindow:  opts.RenewWindow,
+		FlagTemplate: opts.FlagTemplate,
+		FlagEnv:      opts.FlagEnv,
+		FlagPath:     opts.FlagPath,
+	}
+	if err := db.WithContext(ctx).Create(image).Error; err != nil {
 		if dbutil.IsUniqueViolation(err, "image_name_unique_idx") {
-			return ErrDuplicateImage
+			return nil, ErrDuplicateImage
 		}
-		return err
+		return nil, err
 	}
-	return nil
+	return image, nil
+}
+
+func (db *images) List(ctx context.Context) ([]*Image, error) {
+	var images []*Image
+	if err := db.WithContext(ctx).Order("id ASC").Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
 }
 
 var ErrImageNotFound = errors.New("image does not exist")
@@ -114,14 +551,27 @@ func (db *images) GetByUID(ctx context.Context, uid string) (*Image, error) {
 }
 
 type UpdateImageOptions struct {
-	Name       string
-	Domain     string
-	Port       int32
-	Limitation ImageLimitation
+	Name         string
+	Domain       string
+	Ports        []ImagePort
+	Limitation   ImageLimitation
+	Containers   []ImageContainer
+	TTL          time.Duration
+	MaxLifetime  time.Duration
+	MaxRenewals  int
+	RenewWindow  time.Duration
+	FlagTemplate string
+	FlagEnv      string
+	FlagPath     string
 }
 
 func (db *images) Update(ctx context.Context, id uint, opts UpdateImageOptions) error {
+	ports, _ := json.Marshal(opts.Ports)
 	limitation, _ := json.Marshal(opts.Limitation)
+	var containers []byte
+	if len(opts.Containers) != 0 {
+		containers, _ = json.Marshal(opts.Containers)
+	}
 
 	var image Image
 	if err := db.WithContext(ctx).First(&image, id).Error; err != nil {
@@ -130,14 +580,80 @@ func (db *images) Update(ctx context.Context, id uint, opts UpdateImageOptions)
 		}
 		return err
 	}
-	return db.WithContext(ctx).Where("id = ?", id).Updates(&Image{
-		Name:       opts.Name,
-		Domain:     opts.Domain,
-		Port:       opts.Port,
-		Limitation: limitation,
-	}).Error
+	if err := db.WithContext(ctx).Where("id = ?", id).
+		Select("name", "domain", "ports", "limitation", "containers", "ttl", "max_lifetime", "max_renewals", "renew_window",
+			"flag_template", "flag_env", "flag_path").
+		Updates(&Image{
+			Name:         opts.Name,
+			Domain:       opts.Domain,
+			Ports:        ports,
+			Limitation:   limitation,
+			Containers:   containers,
+			TTL:          opts.TTL,
+			MaxLifetime:  opts.MaxLifetime,
+			MaxRenewals:  opts.MaxRenewals,
+			RenewWindow:  opts.RenewWindow,
+			FlagTemplate: opts.FlagTemplate,
+			FlagEnv:      opts.FlagEnv,
+			FlagPath:     opts.FlagPath,
+		}).Error; err != nil {
+		if dbutil.IsUniqueViolation(err, "image_name_unique_idx") {
+			return ErrDuplicateImage
+		}
+		return err
+	}
+	return nil
 }
 
 func (db *images) Delete(ctx context.Context, id uint) error {
 	return db.WithContext(ctx).Delete(&Image{}, id).Error
 }
+
+// migrateImagePorts converts the single HTTP port of the images into their
+// ports, and then drops the "port" column.
+func migrateImagePorts(tx *gorm.DB) error {
+	var rows []struct {
+		ID   uint
+		Port int32
+	}
+	if err := tx.Table("images").Select("id", "port").Scan(&rows).Error; err != nil {
+		return errors.Wrap(err, "get ports")
+	}
+	for _, row := range rows {
+		ports, _ := json.Marshal([]ImagePort{{Port: row.Port, Protocol: ImagePortProtocolHTTP}})
+		if err := tx.Table("images").Where("id = ?", row.ID).Update("ports", datatypes.JSON(ports)).Error; err != nil {
+			return errors.Wrapf(err, "set ports of image %d", row.ID)
+		}
+	}
+	return tx.Exec("ALTER TABLE images DROP COLUMN port").Error
+}
+
+// revertImagePorts restores the "port" column of the images from their first
+// ports, the other ports are lost.
+func revertImagePorts(tx *gorm.DB) error {
+	if err := tx.Exec("ALTER TABLE images ADD COLUMN port INTEGER").Error; err != nil {
+		return errors.Wrap(err, "add port column")
+	}
+
+	var rows []struct {
+		ID    uint
+		Ports datatypes.JSON
+	}
+	if err := tx.Table("images").Select("id", "ports").Scan(&rows).Error; err != nil {
+		return errors.Wrap(err, "get ports")
+	}
+	for _, row := range rows {
+		image := Image{Ports: row.Ports}
+		ports, err := image.GetPorts()
+		if err != nil {
+			return errors.Wrapf(err, "get ports of image %d", row.ID)
+		}
+		if len(ports) == 0 {
+			continue
+		}
+		if err := tx.Table("images").Where("id = ?", row.ID).Update("port", ports[0].Port).Error; err != nil {
+			return errors.Wrapf(err, "set port of image %d", row.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	log "unknwon.dev/clog/v2"
+)
+
+// migrationFiles contains the SQL of the migrations of each dialect, named
+// "<dialect>/<version>_<name>.<up|down>.sql".
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration is a numbered schema change. It runs its embedded SQL file, if
+// any, and then its Go function, if any, within a single transaction.
+type migration struct {
+	Version int
+	Name    string
+	// Check optionally refuses to apply the migration to the existing data,
+	// which needs to be fixed by hand first.
+	Check func(tx *gorm.DB) error
+	// Up and Down are the steps of the migration that can not be expressed in
+	// SQL.
+	Up   func(tx *gorm.DB) error
+	Down func(tx *gorm.DB) error
+	// Irreversible is true if the migration can not be reverted.
+	Irreversible bool
+}
+
+// migrations are all the migrations in order. The released ones must never be
+// changed.
+var migrations = []migration{
+	{Version: 1, Name: "init"},
+	{Version: 2, Name: "admin_keys"},
+	{Version: 3, Name: "user_token_hashes", Up: migrateUserTokens, Irreversible: true},
+	{Version: 4, Name: "instance_lifetime"},
+	{Version: 5, Name: "unique_indexes", Check: checkUniqueDuplicates},
+	{Version: 6, Name: "pod_state"},
+	{Version: 7, Name: "image_ports", Up: migrateImagePorts, Down: revertImagePorts},
+	{Version: 8, Name: "image_containers"},
+	{Version: 9, Name: "flags"},
+	{Version: 10, Name: "pod_containers"},
+}
+
+// LatestSchemaVersion is the version of the schema this binary works with.
+var LatestSchemaVersion = migrations[len(migrations)-1].Version
+
+// schemaMigration is an applied migration, stored in the
+// "schema_migrations" table.
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// MigrationStatus is the status of a migration.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is nil if the migration is pending.
+	AppliedAt *time.Time
+}
+
+// applied returns the applied migrations by their versions.
+func applied(db *gorm.DB) (map[int]schemaMigration, error) {
+	timestampType := "TIMESTAMPTZ"
+	if db.Dialector.Name() == "sqlite" {
+		timestampType = "DATETIME"
+	}
+	if err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    BIGINT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    applied_at %s NOT NULL
+)`, timestampType)).Error; err != nil {
+		return nil, errors.Wrap(err, "create schema migrations table")
+	}
+
+	var rows []schemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, errors.Wrap(err, "get applied migrations")
+	}
+	versions := make(map[int]schemaMigration, len(rows))
+	for _, row := range rows {
+		versions[row.Version] = row
+	}
+	return versions, nil
+}
+
+// MigrationStatuses returns the statuses of all the known migrations, along
+// with the applied ones unknown to this binary.
+func MigrationStatuses(db *gorm.DB) ([]MigrationStatus, error) {
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{
+			Version: m.Version,
+			Name:    m.Name,
+		}
+		if row, ok := versions[m.Version]; ok {
+			status.AppliedAt = &row.AppliedAt
+			delete(versions, m.Version)
+		}
+		statuses = append(statuses, status)
+	}
+
+	unknown := make([]int, 0, len(versions))
+	for v := range versions {
+		unknown = append(unknown, v)
+	}
+	sort.Ints(unknown)
+	for _, v := range unknown {
+		row := versions[v]
+		statuses = append(statuses, MigrationStatus{
+			Version:   row.Version,
+			Name:      row.Name,
+			AppliedAt: &row.AppliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// ErrSchemaAhead is returned when the database has been migrated by a newer
+// binary.
+var ErrSchemaAhead = errors.New("database schema is ahead of the binary")
+
+// checkSchemaAhead returns ErrSchemaAhead if any of the given applied versions
+// is unknown to the binary.
+func checkSchemaAhead(versions map[int]schemaMigration) error {
+	for v := range versions {
+		if v > LatestSchemaVersion {
+			return errors.Wrapf(ErrSchemaAhead, "schema version %d, binary version %d", v, LatestSchemaVersion)
+		}
+	}
+	return nil
+}
+
+// MigrateUp applies the given number of pending migrations, or all of them if
+// n is not positive.
+func MigrateUp(db *gorm.DB, n int) error {
+	versions, err := applied(db)
+	if err != nil {
+		return err
+	}
+	if err := checkSchemaAhead(versions); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := versions[m.Version]; ok {
+			continue
+		}
+		log.Info("Applying migration %04d_%s...", m.Version, m.Name)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if m.Check != nil {
+				if err := m.Check(tx); err != nil {
+					return err
+				}
+			}
+			if err := runMigrationSQL(tx, m, "up"); err != nil {
+				return err
+			}
+			if m.Up != nil {
+				if err := m.Up(tx); err != nil {
+					return err
+				}
+			}
+			return tx.Create(&schemaMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "apply migration %04d_%s", m.Version, m.Name)
+		}
+
+		n--
+		if n == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+// ErrIrreversibleMigration is returned when reverting a migration that can not
+// be reverted.
+var ErrIrreversibleMigration = errors.New("migration is irreversible")
+
+// MigrateDown reverts the given number of latest applied migrations. It
+// refuses to revert anything when the database has been migrated by a newer
+// binary, whose migrations would be left applied on top of the reverted ones.
+func MigrateDown(db *gorm.DB, n int) error {
+	versions, err := applied(db)
+	if err != nil {
+		return err
+	}
+	if err := checkSchemaAhead(versions); err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && n > 0; i-- {
+		m := migrations[i]
+		if _, ok := versions[m.Version]; !ok {
+			continue
+		}
+		if m.Irreversible {
+			return errors.Wrapf(ErrIrreversibleMigration, "revert migration %04d_%s", m.Version, m.Name)
+		}
+
+		log.Info("Reverting migration %04d_%s...", m.Version, m.Name)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if m.Down != nil {
+				if err := m.Down(tx); err != nil {
+					return err
+				}
+			}
+			if err := runMigrationSQL(tx, m, "down"); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "revert migration %04d_%s", m.Version, m.Name)
+		}
+		n--
+	}
+	return nil
+}
+
+// ErrDuplicateRows is returned when the unique indexes can not be created as
+// the existing rows are duplicated.
+var ErrDuplicateRows = errors.New("duplicate rows")
+
+// checkUniqueDuplicates refuses to create the unique indexes of images and
+// users over the duplicates stored by the first release, which did not create
+// them. Unlike the duplicated pods, which of them to keep can not be decided
+// automatically, they need to be renamed or deleted by hand.
+func checkUniqueDuplicates(tx *gorm.DB) error {
+	checks := []struct {
+		table  string
+		column string
+	}{
+		{"images", "name"},
+		{"users", "token_hash"},
+		{"users", "domain"},
+	}
+
+	var msgs []string
+	for _, check := range checks {
+		duplicated := tx.Table(check.table).Select(check.column).Where("deleted_at IS NULL").Group(check.column).Having("COUNT(*) > 1")
+		var ids []uint
+		if err := tx.Table(check.table).Where("deleted_at IS NULL AND "+check.column+" IN (?)", duplicated).Order("id ASC").Pluck("id", &ids).Error; err != nil {
+			return errors.Wrapf(err, "get duplicated %s.%s", check.table, check.column)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		idStrs := make([]string, 0, len(ids))
+		for _, id := range ids {
+			idStrs = append(idStrs, fmt.Sprint(id))
+		}
+		msgs = append(msgs, fmt.Sprintf("%s.%s of IDs %s", check.table, check.column, strings.Join(idStrs, ", ")))
+	}
+	if len(msgs) != 0 {
+		return errors.Wrapf(ErrDuplicateRows, "rename or delete the rows of the duplicated %s first", strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+// runMigrationSQL runs the SQL file of the migration in the given direction
+// for the dialect of the database, if exists.
+func runMigrationSQL(tx *gorm.DB, m migration, direction string) error {
+	name := fmt.Sprintf("migrations/%s/%04d_%s.%s.sql", tx.Dialector.Name(), m.Version, m.Name, direction)
+	query, err := migrationFiles.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return errors.Wrap(err, "read SQL")
+	}
+	return tx.Exec(string(query)).Error
+}
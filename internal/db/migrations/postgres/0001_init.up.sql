@@ -0,0 +1,36 @@
+-- The tables of the first release, which used to be created by AutoMigrate.
+CREATE TABLE IF NOT EXISTS images (
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    uid        TEXT,
+    name       TEXT,
+    domain     TEXT,
+    port       INTEGER,
+    limitation JSONB
+);
+CREATE INDEX IF NOT EXISTS idx_images_deleted_at ON images (deleted_at);
+
+CREATE TABLE IF NOT EXISTS pods (
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    user_id    BIGINT,
+    image_id   BIGINT,
+    name       TEXT,
+    address    TEXT,
+    expired_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_pods_deleted_at ON pods (deleted_at);
+
+CREATE TABLE IF NOT EXISTS users (
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    token      TEXT,
+    domain     TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
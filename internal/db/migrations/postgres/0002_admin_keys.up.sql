@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS admin_keys (
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    name       TEXT,
+    key_hash   TEXT,
+    scopes     JSONB
+);
+CREATE INDEX IF NOT EXISTS idx_admin_keys_deleted_at ON admin_keys (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS admin_key_hash_unique_idx ON admin_keys (key_hash) WHERE deleted_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id             BIGSERIAL PRIMARY KEY,
+    created_at     TIMESTAMPTZ,
+    updated_at     TIMESTAMPTZ,
+    deleted_at     TIMESTAMPTZ,
+    admin_key_id   BIGINT,
+    admin_key_name TEXT,
+    method         TEXT,
+    path           TEXT,
+    status_code    BIGINT,
+    remote_addr    TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_deleted_at ON audit_logs (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_admin_key_id ON audit_logs (admin_key_id);
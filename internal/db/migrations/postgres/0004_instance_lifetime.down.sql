@@ -0,0 +1,5 @@
+ALTER TABLE pods DROP COLUMN IF EXISTS renewals;
+ALTER TABLE images DROP COLUMN IF EXISTS renew_window;
+ALTER TABLE images DROP COLUMN IF EXISTS max_renewals;
+ALTER TABLE images DROP COLUMN IF EXISTS max_lifetime;
+ALTER TABLE images DROP COLUMN IF EXISTS ttl;
@@ -0,0 +1,5 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS ttl BIGINT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS max_lifetime BIGINT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS max_renewals BIGINT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS renew_window BIGINT;
+ALTER TABLE pods ADD COLUMN IF NOT EXISTS renewals BIGINT;
@@ -0,0 +1,14 @@
+-- The unique indexes of the first release were never created as their struct
+-- tags were not read by GORM.
+-- The duplicated image names, user tokens and user domains are refused by
+-- checkUniqueDuplicates beforehand, and need to be fixed by hand.
+CREATE UNIQUE INDEX IF NOT EXISTS image_name_unique_idx ON images (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS user_token_hash_unique_idx ON users (token_hash) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS user_domain_unique_idx ON users (domain) WHERE deleted_at IS NULL;
+
+-- Keep the oldest of the duplicated pods, they share the same cluster
+-- resources.
+UPDATE pods SET deleted_at = NOW()
+WHERE deleted_at IS NULL
+  AND id NOT IN (SELECT MIN(id) FROM pods WHERE deleted_at IS NULL GROUP BY user_id, image_id);
+CREATE UNIQUE INDEX IF NOT EXISTS pod_user_image_unique_idx ON pods (user_id, image_id) WHERE deleted_at IS NULL;
@@ -0,0 +1 @@
+ALTER TABLE pods ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT 'provisioned';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS pod_flag_idx;
+ALTER TABLE pods DROP COLUMN IF EXISTS flag;
+ALTER TABLE images DROP COLUMN IF EXISTS flag_path;
+ALTER TABLE images DROP COLUMN IF EXISTS flag_env;
+ALTER TABLE images DROP COLUMN IF EXISTS flag_template;
@@ -0,0 +1,5 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS flag_template TEXT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS flag_env TEXT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS flag_path TEXT;
+ALTER TABLE pods ADD COLUMN IF NOT EXISTS flag TEXT;
+CREATE INDEX IF NOT EXISTS pod_flag_idx ON pods (flag);
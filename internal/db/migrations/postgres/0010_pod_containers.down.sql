@@ -0,0 +1 @@
+ALTER TABLE pods DROP COLUMN IF EXISTS containers;
@@ -0,0 +1 @@
+ALTER TABLE pods ADD COLUMN IF NOT EXISTS containers INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,35 @@
+CREATE TABLE images (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    deleted_at DATETIME,
+    uid        TEXT,
+    name       TEXT,
+    domain     TEXT,
+    port       INTEGER,
+    limitation JSON
+);
+CREATE INDEX idx_images_deleted_at ON images (deleted_at);
+
+CREATE TABLE pods (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    deleted_at DATETIME,
+    user_id    INTEGER,
+    image_id   INTEGER,
+    name       TEXT,
+    address    TEXT,
+    expired_at DATETIME
+);
+CREATE INDEX idx_pods_deleted_at ON pods (deleted_at);
+
+CREATE TABLE users (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    deleted_at DATETIME,
+    token      TEXT,
+    domain     TEXT
+);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
@@ -0,0 +1,26 @@
+CREATE TABLE admin_keys (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    deleted_at DATETIME,
+    name       TEXT,
+    key_hash   TEXT,
+    scopes     JSON
+);
+CREATE INDEX idx_admin_keys_deleted_at ON admin_keys (deleted_at);
+CREATE UNIQUE INDEX admin_key_hash_unique_idx ON admin_keys (key_hash) WHERE deleted_at IS NULL;
+
+CREATE TABLE audit_logs (
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at     DATETIME,
+    updated_at     DATETIME,
+    deleted_at     DATETIME,
+    admin_key_id   INTEGER,
+    admin_key_name TEXT,
+    method         TEXT,
+    path           TEXT,
+    status_code    INTEGER,
+    remote_addr    TEXT
+);
+CREATE INDEX idx_audit_logs_deleted_at ON audit_logs (deleted_at);
+CREATE INDEX idx_audit_logs_admin_key_id ON audit_logs (admin_key_id);
@@ -0,0 +1,5 @@
+ALTER TABLE pods DROP COLUMN renewals;
+ALTER TABLE images DROP COLUMN renew_window;
+ALTER TABLE images DROP COLUMN max_renewals;
+ALTER TABLE images DROP COLUMN max_lifetime;
+ALTER TABLE images DROP COLUMN ttl;
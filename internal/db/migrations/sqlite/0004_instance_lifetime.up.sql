@@ -0,0 +1,5 @@
+ALTER TABLE images ADD COLUMN ttl INTEGER;
+ALTER TABLE images ADD COLUMN max_lifetime INTEGER;
+ALTER TABLE images ADD COLUMN max_renewals INTEGER;
+ALTER TABLE images ADD COLUMN renew_window INTEGER;
+ALTER TABLE pods ADD COLUMN renewals INTEGER;
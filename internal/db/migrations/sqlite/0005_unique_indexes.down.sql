@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS pod_user_image_unique_idx;
+DROP INDEX IF EXISTS user_domain_unique_idx;
+DROP INDEX IF EXISTS user_token_hash_unique_idx;
+DROP INDEX IF EXISTS image_name_unique_idx;
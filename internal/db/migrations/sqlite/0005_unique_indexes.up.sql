@@ -0,0 +1,6 @@
+-- The duplicated image names, user tokens and user domains are refused by
+-- checkUniqueDuplicates beforehand, and need to be fixed by hand.
+CREATE UNIQUE INDEX image_name_unique_idx ON images (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX user_token_hash_unique_idx ON users (token_hash) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX user_domain_unique_idx ON users (domain) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX pod_user_image_unique_idx ON pods (user_id, image_id) WHERE deleted_at IS NULL;
@@ -0,0 +1 @@
+ALTER TABLE pods ADD COLUMN state TEXT NOT NULL DEFAULT 'provisioned';
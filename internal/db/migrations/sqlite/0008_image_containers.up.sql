@@ -0,0 +1 @@
+ALTER TABLE images ADD COLUMN containers JSON;
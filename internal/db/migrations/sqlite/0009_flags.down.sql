@@ -0,0 +1,5 @@
+DROP INDEX pod_flag_idx;
+ALTER TABLE pods DROP COLUMN flag;
+ALTER TABLE images DROP COLUMN flag_path;
+ALTER TABLE images DROP COLUMN flag_env;
+ALTER TABLE images DROP COLUMN flag_template;
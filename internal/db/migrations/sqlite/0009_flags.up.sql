@@ -0,0 +1,5 @@
+ALTER TABLE images ADD COLUMN flag_template TEXT;
+ALTER TABLE images ADD COLUMN flag_env TEXT;
+ALTER TABLE images ADD COLUMN flag_path TEXT;
+ALTER TABLE pods ADD COLUMN flag TEXT;
+CREATE INDEX pod_flag_idx ON pods (flag);
@@ -0,0 +1 @@
+ALTER TABLE pods DROP COLUMN containers;
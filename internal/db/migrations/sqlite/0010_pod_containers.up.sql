@@ -0,0 +1 @@
+ALTER TABLE pods ADD COLUMN containers INTEGER NOT NULL DEFAULT 0;
@@ -11,6 +11,7 @@ import (
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
 
+	"github.com/wuhan005/oblivion/internal/conf"
 	"github.com/wuhan005/oblivion/internal/dbutil"
 )
 
@@ -21,10 +22,20 @@ var Pods PodsStore
 
 // PodsStore is the persistent interface for pods.
 type PodsStore interface {
+	// Create creates a new pod in the provisioning state. It returns
+	// ErrDuplicatePod if the user already has a pod of the image, which makes
+	// it the reservation serializing the creations per user and image.
 	Create(ctx context.Context, opts CreatePodOptions) (*Pod, error)
 	Get(ctx context.Context, opts GetPodsOptions) ([]*Pod, error)
 	GetByID(ctx context.Context, id uint) (*Pod, error)
-	GetExpired(ctx context.Context) ([]*Pod, error)
+	// GetByFlag returns the pods issued the given flag, including the deleted
+	// ones.
+	GetByFlag(ctx context.Context, flag string) ([]*Pod, error)
+	GetExpired(ctx context.Context, now time.Time) ([]*Pod, error)
+	GetNextExpiredAt(ctx context.Context, after time.Time) (time.Time, error)
+	// SetProvisioned marks the pod as provisioned.
+	SetProvisioned(ctx context.Context, id uint) error
+	Renew(ctx context.Context, id uint, opts RenewPodOptions) error
 	Delete(ctx context.Context, id uint) error
 }
 
@@ -33,17 +44,37 @@ func NewPodsStore(db *gorm.DB) PodsStore {
 	return &pods{DB: db}
 }
 
+// PodState is the provisioning state of a pod.
+type PodState string
+
+const (
+	// PodStateProvisioning is the state of a pod whose cluster resources are
+	// being created. The pod is recorded first so the resources are never left
+	// behind without a record.
+	PodStateProvisioning PodState = "provisioning"
+	PodStateProvisioned  PodState = "provisioned"
+)
+
 type Pod struct {
 	gorm.Model
 
-	UserID  uint   `uniqueIndex:"pod_user_image_unique_idx, where:deleted_at IS NULL" json:"-"`
+	UserID  uint   `gorm:"uniqueIndex:pod_user_image_unique_idx,where:deleted_at IS NULL" json:"-"`
 	User    *User  `gorm:"-" json:"-"`
-	ImageID uint   `uniqueIndex:"pod_user_image_unique_idx, where:deleted_at IS NULL" json:"-"`
+	ImageID uint   `gorm:"uniqueIndex:pod_user_image_unique_idx,where:deleted_at IS NULL" json:"-"`
 	Image   *Image `gorm:"-" json:"-"`
 
 	Name      string
 	Address   string
 	ExpiredAt time.Time
+	Renewals  int
+	State     PodState
+	// Flag is the flag issued to the user in the instance, empty if the image
+	// has no flag template.
+	Flag string `gorm:"index:pod_flag_idx" json:"-"`
+	// Containers is the number of containers the instance is provisioned with,
+	// each running in its own cluster pod. It is zero for the pods recorded by
+	// the previous versions.
+	Containers int `json:"-"`
 }
 
 type pods struct {
@@ -56,21 +87,27 @@ type CreatePodOptions struct {
 	Name      string
 	Address   string
 	ExpiredAt time.Time
+	Flag      string
+	// Containers is the number of containers of the image at the time.
+	Containers int
 }
 
 var ErrDuplicatePod = errors.New("duplicate pod")
 
 func (db *pods) Create(ctx context.Context, opts CreatePodOptions) (*Pod, error) {
 	pod := &Pod{
-		UserID:    opts.UserID,
-		ImageID:   opts.ImageID,
-		Name:      opts.Name,
-		Address:   opts.Address,
-		ExpiredAt: opts.ExpiredAt,
+		UserID:     opts.UserID,
+		ImageID:    opts.ImageID,
+		Name:       opts.Name,
+		Address:    opts.Address,
+		ExpiredAt:  opts.ExpiredAt,
+		State:      PodStateProvisioning,
+		Flag:       opts.Flag,
+		Containers: opts.Containers,
 	}
 	if err := db.WithContext(ctx).Create(pod).Error; err != nil {
 		if dbutil.IsUniqueViolation(err, "pod_user_image_unique_idx") {
-			return nil, ErrDuplicateUser
+			return nil, ErrDuplicatePod
 		}
 		return nil, err
 	}
@@ -110,52 +147,117 @@ func (db *pods) GetByID(ctx context.Context, id uint) (*Pod, error) {
 	return pods[0], nil
 }
 
-func (db *pods) GetExpired(ctx context.Context) ([]*Pod, error) {
+func (db *pods) GetByFlag(ctx context.Context, flag string) ([]*Pod, error) {
+	var pods []*Pod
+	if err := db.WithContext(ctx).Unscoped().Where("flag = ?", flag).Order("id ASC").Find(&pods).Error; err != nil {
+		return nil, err
+	}
+	return db.loadAttributes(ctx, pods...)
+}
+
+// GetExpired returns the pods expired at the given time. The pods being
+// provisioned are left out, unless they are older than the reconcile grace
+// period, in which case their provisioning has been interrupted.
+func (db *pods) GetExpired(ctx context.Context, now time.Time) ([]*Pod, error) {
 	var pods []*Pod
-	if err := db.WithContext(ctx).Model(&Pod{}).Where("pods.expired_at < CURRENT_DATE").Find(&pods).Error; err != nil {
+	if err := db.WithContext(ctx).Model(&Pod{}).
+		Where("pods.expired_at <= ?", now).
+		Where("pods.state <> ? OR pods.created_at <= ?", PodStateProvisioning, time.Now().Add(-conf.Jobs.ReconcileGracePeriod)).
+		Find(&pods).Error; err != nil {
 		return nil, err
 	}
 	return db.loadAttributes(ctx, pods...)
 }
 
+// GetNextExpiredAt returns the earliest expiry time of the pods expiring after
+// the given time, or ErrPodsNotFound if there is no such pod.
+func (db *pods) GetNextExpiredAt(ctx context.Context, after time.Time) (time.Time, error) {
+	var pod Pod
+	if err := db.WithContext(ctx).Model(&Pod{}).Where("pods.expired_at > ?", after).Order("pods.expired_at ASC").First(&pod).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, ErrPodsNotFound
+		}
+		return time.Time{}, err
+	}
+	return pod.ExpiredAt, nil
+}
+
+func (db *pods) SetProvisioned(ctx context.Context, id uint) error {
+	return db.WithContext(ctx).Model(&Pod{}).Where("id = ?", id).Update("state", PodStateProvisioned).Error
+}
+
+type RenewPodOptions struct {
+	// Renewals is the renewal count of the pod being renewed.
+	Renewals  int
+	ExpiredAt time.Time
+}
+
+var ErrPodRenewed = errors.New("pod has been renewed concurrently")
+
+// Renew sets the expiry time of the pod and increases its renewal count. It
+// returns ErrPodRenewed if the renewal count is no longer the given one.
+func (db *pods) Renew(ctx context.Context, id uint, opts RenewPodOptions) error {
+	tx := db.WithContext(ctx).Model(&Pod{}).Where("id = ? AND renewals = ?", id, opts.Renewals).Updates(map[string]interface{}{
+		"expired_at": opts.ExpiredAt,
+		"renewals":   opts.Renewals + 1,
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrPodRenewed
+	}
+	return nil
+}
+
 func (db *pods) Delete(ctx context.Context, id uint) error {
 	return db.WithContext(ctx).Delete(&Pod{}, id).Error
 }
 
+// loadAttributes loads the users and the images of the given pods. They are
+// loaded even if they have been deleted, so the pods left behind by them can
+// still be torn down.
 func (db *pods) loadAttributes(ctx context.Context, pods ...*Pod) ([]*Pod, error) {
-	userIDs := map[uint]struct{}{}
-	imageIDs := map[uint]struct{}{}
+	if len(pods) == 0 {
+		return pods, nil
+	}
+
+	userIDs := make([]uint, 0, len(pods))
+	imageIDs := make([]uint, 0, len(pods))
 	for _, pod := range pods {
-		userIDs[pod.UserID] = struct{}{}
-		imageIDs[pod.ImageID] = struct{}{}
+		userIDs = append(userIDs, pod.UserID)
+		imageIDs = append(imageIDs, pod.ImageID)
 	}
 
 	// Get pods' users.
-	usersStore := NewUsersStore(db.DB)
-	userSets := map[uint]*User{}
-	for userID := range userIDs {
-		var err error
-		userSets[userID], err = usersStore.GetByID(ctx, userID)
-		if err != nil {
-			return nil, errors.Wrap(err, "get users")
-		}
+	var users []*User
+	if err := db.WithContext(ctx).Unscoped().Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		return nil, errors.Wrap(err, "get users")
+	}
+	userSets := make(map[uint]*User, len(users))
+	for _, user := range users {
+		userSets[user.ID] = user
 	}
 
 	// Get pods' images.
-	imagesStore := NewImagesStore(db.DB)
-	imageSets := map[uint]*Image{}
-	for imageID := range imageIDs {
-		var err error
-		imageSets[imageID], err = imagesStore.GetByID(ctx, imageID)
-		if err != nil {
-			return nil, errors.Wrap(err, "get image")
-		}
+	var images []*Image
+	if err := db.WithContext(ctx).Unscoped().Where("id IN ?", imageIDs).Find(&images).Error; err != nil {
+		return nil, errors.Wrap(err, "get images")
+	}
+	imageSets := make(map[uint]*Image, len(images))
+	for _, image := range images {
+		imageSets[image.ID] = image
 	}
 
 	for _, pod := range pods {
 		pod.User = userSets[pod.UserID]
+		if pod.User == nil {
+			return nil, errors.Wrapf(ErrUserNotFound, "user %d of pod %d", pod.UserID, pod.ID)
+		}
 		pod.Image = imageSets[pod.ImageID]
+		if pod.Image == nil {
+			return nil, errors.Wrapf(ErrImageNotFound, "image %d of pod %d", pod.ImageID, pod.ID)
+		}
 	}
-
 	return pods, nil
 }
@@ -6,11 +6,17 @@ package db
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/thanhpk/randstr"
 	"gorm.io/gorm"
 
+	"github.com/wuhan005/oblivion/internal/conf"
 	"github.com/wuhan005/oblivion/internal/dbutil"
 )
 
@@ -23,8 +29,11 @@ var Users UsersStore
 type UsersStore interface {
 	// Create creates a new user.
 	Create(ctx context.Context, opts CreateUserOptions) error
-	// BatchCreate creates new users in batch.
-	BatchCreate(ctx context.Context, opts BatchCreateOptions) error
+	// BatchCreate creates new users in batch within a single transaction. It
+	// returns a *DuplicateUsersError listing the offending tokens if any of the
+	// given tokens is repeated or already exists. The plaintext tokens are only
+	// set on the returned users, they are stored hashed.
+	BatchCreate(ctx context.Context, opts BatchCreateOptions) ([]*User, error)
 	// GetByID returns a user by its ID.
 	GetByID(ctx context.Context, id uint) (*User, error)
 	// GetByToken returns a user by its token.
@@ -43,8 +52,9 @@ func NewUsersStore(db *gorm.DB) UsersStore {
 type User struct {
 	gorm.Model
 
-	Token  string `uniqueIndex:"user_token_unique_idx, where:deleted_at IS NULL"`
-	Domain string `uniqueIndex:"user_domain_unique_idx, where:deleted_at IS NULL"`
+	Token     string `gorm:"-" json:",omitempty"`
+	TokenHash string `gorm:"uniqueIndex:user_token_hash_unique_idx,where:deleted_at IS NULL" json:"-"`
+	Domain    string `gorm:"uniqueIndex:user_domain_unique_idx,where:deleted_at IS NULL"`
 }
 
 type users struct {
@@ -57,12 +67,16 @@ type CreateUserOptions struct {
 
 var ErrDuplicateUser = errors.New("duplicate user")
 
+// domainLetters are the letters of the generated user domains, which are
+// lowercase as they are part of the hostnames and the resource names.
+const domainLetters = "0123456789abcdefghijklmnopqrstuvwxyz"
+
 func (db *users) Create(ctx context.Context, opts CreateUserOptions) error {
 	if err := db.WithContext(ctx).Create(&User{
-		Token:  opts.Token,
-		Domain: randstr.String(8),
+		TokenHash: HashUserToken(opts.Token),
+		Domain:    randstr.String(8, domainLetters),
 	}).Error; err != nil {
-		if dbutil.IsUniqueViolation(err, "user_token_unique_idx") {
+		if dbutil.IsUniqueViolation(err, "user_token_hash_unique_idx") {
 			return ErrDuplicateUser
 		}
 		return err
@@ -72,23 +86,108 @@ func (db *users) Create(ctx context.Context, opts CreateUserOptions) error {
 
 type BatchCreateOptions struct {
 	Tokens []string
+	// Generate is the number of random tokens to generate in addition to the
+	// given tokens.
+	Generate int
+}
+
+// DuplicateUsersError is returned by BatchCreate when some of the tokens are
+// duplicated, it matches ErrDuplicateUser with errors.Is.
+type DuplicateUsersError struct {
+	Tokens []string
+}
+
+func (err *DuplicateUsersError) Error() string {
+	return fmt.Sprintf("duplicate users: %s", strings.Join(err.Tokens, ", "))
 }
 
-func (db *users) BatchCreate(ctx context.Context, opts BatchCreateOptions) error {
-	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		for _, token := range opts.Tokens {
-			if err := tx.Create(&User{
-				Token:  token,
-				Domain: randstr.String(8),
-			}).Error; err != nil {
-				if dbutil.IsUniqueViolation(err, "user_token_unique_idx") {
-					return ErrDuplicateUser
-				}
-				return err
+func (err *DuplicateUsersError) Is(target error) bool {
+	return target == ErrDuplicateUser
+}
+
+func (db *users) BatchCreate(ctx context.Context, opts BatchCreateOptions) ([]*User, error) {
+	tokens := opts.Tokens
+	for i := 0; i < opts.Generate; i++ {
+		tokens = append(tokens, randstr.Hex(16))
+	}
+
+	users := make([]*User, 0, len(tokens))
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		tokenHashes := make(map[string]string, len(tokens))
+		for _, token := range tokens {
+			tokenHashes[HashUserToken(token)] = token
+		}
+		hashes := make([]string, 0, len(tokenHashes))
+		for hash := range tokenHashes {
+			hashes = append(hashes, hash)
+		}
+
+		var existingHashes []string
+		if len(hashes) != 0 {
+			if err := tx.Model(&User{}).Where("token_hash IN ?", hashes).Pluck("token_hash", &existingHashes).Error; err != nil {
+				return errors.Wrap(err, "get existing tokens")
+			}
+		}
+		duplicates := make([]string, 0, len(existingHashes))
+		for _, hash := range existingHashes {
+			duplicates = append(duplicates, tokenHashes[hash])
+		}
+
+		seen := make(map[string]struct{}, len(tokens))
+		for _, token := range duplicates {
+			seen[token] = struct{}{}
+		}
+		for _, token := range tokens {
+			if _, ok := seen[token]; ok {
+				continue
+			}
+			seen[token] = struct{}{}
+			users = append(users, &User{
+				Token:     token,
+				TokenHash: HashUserToken(token),
+				Domain:    randstr.String(8, domainLetters),
+			})
+		}
+		if len(users) != len(tokens) {
+			return &DuplicateUsersError{Tokens: duplicateTokens(tokens, duplicates)}
+		}
+		if len(users) == 0 {
+			return nil
+		}
+
+		if err := tx.Create(&users).Error; err != nil {
+			if dbutil.IsUniqueViolation(err, "user_token_hash_unique_idx") {
+				return ErrDuplicateUser
 			}
+			return err
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// duplicateTokens returns the tokens that are repeated in the given list or
+// already exist, in the order they first appear.
+func duplicateTokens(tokens, existing []string) []string {
+	counts := make(map[string]int, len(tokens))
+	for _, token := range existing {
+		counts[token]++
+	}
+	for _, token := range tokens {
+		counts[token]++
+	}
+
+	var duplicates []string
+	for _, token := range tokens {
+		if counts[token] > 1 {
+			duplicates = append(duplicates, token)
+			counts[token] = 0
+		}
+	}
+	return duplicates
 }
 
 var ErrUserNotFound = errors.New("user dose not exist")
@@ -106,7 +205,7 @@ func (db *users) GetByID(ctx context.Context, id uint) (*User, error) {
 
 func (db *users) GetByToken(ctx context.Context, token string) (*User, error) {
 	var user User
-	if err := db.WithContext(ctx).Where("token = ?", token).First(&user).Error; err != nil {
+	if err := db.WithContext(ctx).Where("token_hash = ?", HashUserToken(token)).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, ErrUserNotFound
 		}
@@ -129,3 +228,39 @@ func (db *users) GetByDomain(ctx context.Context, domain string) (*User, error)
 func (db *users) Delete(ctx context.Context, id uint) error {
 	return db.WithContext(ctx).Delete(&User{}, id).Error
 }
+
+// HashUserToken returns the HMAC-SHA256 of the user token keyed with the
+// server-side pepper, which is what gets stored in the database.
+func HashUserToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(conf.Security.TokenPepper))
+	_, _ = mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// migrateUserTokens hashes the plaintext tokens stored by the previous
+// versions into the "token_hash" column, and then drops the plaintext "token"
+// column.
+func migrateUserTokens(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn("users", "token_hash") {
+		if err := tx.Exec("ALTER TABLE users ADD COLUMN token_hash TEXT").Error; err != nil {
+			return errors.Wrap(err, "add token hash column")
+		}
+	}
+	if !tx.Migrator().HasColumn("users", "token") {
+		return nil
+	}
+
+	var rows []struct {
+		ID    uint
+		Token string
+	}
+	if err := tx.Table("users").Select("id", "token").Where("token IS NOT NULL AND token <> ''").Scan(&rows).Error; err != nil {
+		return errors.Wrap(err, "get plaintext tokens")
+	}
+	for _, row := range rows {
+		if err := tx.Table("users").Where("id = ?", row.ID).Update("token_hash", HashUserToken(row.Token)).Error; err != nil {
+			return errors.Wrapf(err, "hash token of user %d", row.ID)
+		}
+	}
+	return tx.Exec("ALTER TABLE users DROP COLUMN token").Error
+}
@@ -6,6 +6,11 @@ import (
 	"time"
 )
 
+// Clock returns the current time. It is injected where the current time
+// matters so that it can be replaced.
+type Clock func() time.Time
+
+// Now returns the current time truncated to the precision of the database.
 func Now() time.Time {
 	return time.Now().Truncate(time.Microsecond)
 }
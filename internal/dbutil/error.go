@@ -6,9 +6,23 @@ import (
 	"github.com/jackc/pgconn"
 )
 
+// IsUniqueViolation returns true if the error violates the given unique
+// constraint.
 func IsUniqueViolation(err error, constraint string) bool {
-	// NOTE: How to check if error type is DUPLICATE KEY in GORM.
-	// https://github.com/go-gorm/gorm/issues/4037
-	pgError, ok := err.(*pgconn.PgError)
-	return ok && pgError.Code == "23505" && pgError.ConstraintName == constraint
+	if err, ok := err.(*pgconn.PgError); ok {
+		// NOTE: How to check if error type is DUPLICATE KEY in GORM.
+		// https://github.com/go-gorm/gorm/issues/4037
+		return err.Code == "23505" && err.ConstraintName == constraint
+	}
+	return isSQLiteUniqueViolation(err, constraint)
+}
+
+// sqliteUniqueColumns maps the unique constraints to their columns, which is
+// what SQLite reports in place of the name of the violated constraint.
+var sqliteUniqueColumns = map[string]string{
+	"image_name_unique_idx":      "images.name",
+	"user_token_hash_unique_idx": "users.token_hash",
+	"user_domain_unique_idx":     "users.domain",
+	"pod_user_image_unique_idx":  "pods.user_id, pods.image_id",
+	"admin_key_hash_unique_idx":  "admin_keys.key_hash",
 }
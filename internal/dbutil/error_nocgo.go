@@ -0,0 +1,14 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package dbutil
+
+// isSQLiteUniqueViolation always returns false, as the SQLite driver needs cgo
+// and is not available.
+func isSQLiteUniqueViolation(error, string) bool {
+	return false
+}
@@ -0,0 +1,23 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package dbutil
+
+import (
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func isSQLiteUniqueViolation(err error, constraint string) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return false
+	}
+	columns, ok := sqliteUniqueColumns[constraint]
+	return ok && strings.TrimPrefix(sqliteErr.Error(), "UNIQUE constraint failed: ") == columns
+}
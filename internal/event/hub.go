@@ -0,0 +1,131 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wuhan005/oblivion/internal/orchestrator"
+)
+
+// Type is the type of an instance lifecycle event.
+type Type string
+
+const (
+	TypeCreated      Type = "created"
+	TypeStatus       Type = "status"
+	TypeReady        Type = "ready"
+	TypeExpiringSoon Type = "expiring_soon"
+	TypeExpired      Type = "expired"
+	TypeDeleted      Type = "deleted"
+)
+
+// Event is a lifecycle event of an instance.
+type Event struct {
+	Type      Type
+	Time      time.Time
+	Status    *orchestrator.Status `json:",omitempty"`
+	ExpiredAt *time.Time           `json:",omitempty"`
+}
+
+// subscriberBuffer is the number of events buffered for a subscriber, the
+// events are dropped for a subscriber that falls behind.
+const subscriberBuffer = 16
+
+// Hub fans out the lifecycle events of the instances to their subscribers.
+// The instances are identified by their namespaces.
+type Hub struct {
+	mu          sync.RWMutex
+	closed      bool
+	subscribers map[string]map[chan Event]struct{}
+}
+
+// NewHub returns a new Hub.
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: map[string]map[chan Event]struct{}{},
+	}
+}
+
+// Subscribe returns the channel receiving the events of the instance in the
+// given namespace, and the function to unsubscribe. The channel is closed when
+// the hub is closed.
+func (h *Hub) Subscribe(namespace string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subscribers[namespace] == nil {
+		h.subscribers[namespace] = map[chan Event]struct{}{}
+	}
+	h.subscribers[namespace][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.closed {
+			return
+		}
+		delete(h.subscribers[namespace], ch)
+		if len(h.subscribers[namespace]) == 0 {
+			delete(h.subscribers, namespace)
+		}
+	}
+}
+
+// Publish sends the event to all the subscribers of the instance in the given
+// namespace without blocking.
+func (h *Hub) Publish(namespace string, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch := range h.subscribers[namespace] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// PublishStatus publishes the status of the instance in the given namespace,
+// along with the ready event if it is ready.
+func (h *Hub) PublishStatus(namespace string, status *orchestrator.Status) {
+	h.Publish(namespace, Event{
+		Type:   TypeStatus,
+		Status: status,
+	})
+	if status.Ready {
+		h.Publish(namespace, Event{
+			Type:   TypeReady,
+			Status: status,
+		})
+	}
+}
+
+// Close closes the channels of all the subscribers, which ends the streams
+// being served so the server can shut down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for _, chs := range h.subscribers {
+		for ch := range chs {
+			close(ch)
+		}
+	}
+	h.subscribers = nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/wuhan005/oblivion/internal/orchestrator"
+)
+
+// WatchPods publishes the status transitions of the instances watched by the
+// shared informer factory to the hub, the status of an instance is derived
+// from all of its pods. It must be called before the factory is started.
+func WatchPods(factory informers.SharedInformerFactory, hub *Hub) {
+	informer := factory.Core().V1().Pods()
+	lister := informer.Lister()
+
+	// The handlers are called sequentially, so the last published statuses
+	// need no lock.
+	published := map[string]*orchestrator.Status{}
+	publish := func(namespace string) {
+		pods, err := lister.Pods(namespace).List(labels.Everything())
+		if err != nil || len(pods) == 0 {
+			delete(published, namespace)
+			return
+		}
+
+		status := orchestrator.InstanceStatus(pods)
+		if old, ok := published[namespace]; ok && old.Phase == status.Phase && old.RestartCount == status.RestartCount {
+			return
+		}
+		published[namespace] = status
+		hub.PublishStatus(namespace, status)
+	}
+
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				publish(pod.Namespace)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if pod, ok := newObj.(*v1.Pod); ok {
+				publish(pod.Namespace)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*v1.Pod); ok {
+				publish(pod.Namespace)
+			}
+		},
+	})
+}
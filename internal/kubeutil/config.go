@@ -0,0 +1,43 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package kubeutil
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewConfig returns the config to access the Kubernetes API server. It loads
+// the given kubeconfig file, or the ones in the KUBECONFIG environment
+// variable, and falls back to the in-cluster service account with the mounted
+// CA bundle. The server certificate is always verified unless
+// insecureSkipTLSVerify is explicitly set.
+func NewConfig(kubeconfig string, insecureSkipTLSVerify bool) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig != "" || os.Getenv(clientcmd.RecommendedConfigPathEnvVar) != "" {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = kubeconfig
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "load kubeconfig")
+		}
+	} else {
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "load in-cluster config")
+		}
+	}
+
+	if insecureSkipTLSVerify {
+		config.TLSClientConfig.Insecure = true
+		config.TLSClientConfig.CAFile = ""
+		config.TLSClientConfig.CAData = nil
+	}
+	return config, nil
+}
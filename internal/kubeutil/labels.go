@@ -0,0 +1,56 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package kubeutil
+
+import (
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// LabelManagedBy marks the resources created by oblivion.
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	// LabelUserID is the ID of the user owning the instance.
+	LabelUserID = "oblivion.io/user-id"
+	// LabelImageUID is the UID of the image of the instance.
+	LabelImageUID = "oblivion.io/image-uid"
+	// LabelContainer is the name of the container of a multi-container image
+	// running in the pod.
+	LabelContainer = "oblivion.io/container"
+
+	managedByOblivion = "oblivion"
+)
+
+// Labels returns the labels of the resources belonging to the instance of the
+// given user and image. They contain no secret and are used as the selector
+// of the instance's service.
+func Labels(userID uint, imageUID string) map[string]string {
+	return map[string]string{
+		LabelManagedBy: managedByOblivion,
+		LabelUserID:    strconv.FormatUint(uint64(userID), 10),
+		LabelImageUID:  imageUID,
+	}
+}
+
+// ManagedSelector returns the label selector matching all the resources
+// created by oblivion.
+func ManagedSelector() string {
+	return labels.SelectorFromSet(labels.Set{LabelManagedBy: managedByOblivion}).String()
+}
+
+// NewInformerFactory returns a shared informer factory watching the resources
+// created by oblivion, to be shared by everything watching the cluster.
+func NewInformerFactory(client kubernetes.Interface) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(client, 10*time.Minute,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = ManagedSelector()
+		}),
+	)
+}
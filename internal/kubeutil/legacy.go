@@ -0,0 +1,158 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package kubeutil
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/db"
+)
+
+const (
+	// legacyLabelTeamToken is the label used by the previous versions, which
+	// carried the plaintext team token.
+	legacyLabelTeamToken = "team_token"
+	legacyLabelImageUID  = "image_uid"
+)
+
+// MigrateLegacyLabels replaces the legacy labels, which carry the plaintext
+// team token, of the pods, services and ingresses created by the previous
+// versions with the labels returned by Labels. The services are switched to
+// the new selector before the legacy labels are removed from the pods, so the
+// instances keep being reachable during the migration. The resources of the
+// users that no longer exist are left without a user, and are then
+// garbage-collected by the reconciler as no pod owns their namespaces.
+func MigrateLegacyLabels(ctx context.Context, client kubernetes.Interface) error {
+	listOptions := metav1.ListOptions{LabelSelector: legacyLabelTeamToken}
+
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return errors.Wrap(err, "list pods")
+	}
+	services, err := client.CoreV1().Services(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return errors.Wrap(err, "list services")
+	}
+	ingresses, err := client.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return errors.Wrap(err, "list ingresses")
+	}
+
+	userIDs := map[string]uint{}
+	newLabels := func(legacyLabels map[string]string) (map[string]interface{}, error) {
+		token := legacyLabels[legacyLabelTeamToken]
+		userID, ok := userIDs[token]
+		if !ok {
+			user, err := db.Users.GetByToken(ctx, token)
+			if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+				return nil, errors.Wrap(err, "get user by token")
+			}
+			if user != nil {
+				userID = user.ID
+			}
+			userIDs[token] = userID
+		}
+
+		patch := map[string]interface{}{}
+		for k, v := range Labels(userID, legacyLabels[legacyLabelImageUID]) {
+			patch[k] = v
+		}
+		if userID == 0 {
+			// The user no longer exists, the resources are only labelled as
+			// managed so the reconciler garbage-collects them.
+			delete(patch, LabelUserID)
+		}
+		return patch, nil
+	}
+	withoutLegacy := func(labels map[string]interface{}) map[string]interface{} {
+		patch := map[string]interface{}{
+			legacyLabelTeamToken: nil,
+			legacyLabelImageUID:  nil,
+		}
+		for k, v := range labels {
+			patch[k] = v
+		}
+		return patch
+	}
+	namespaces := map[string]map[string]interface{}{}
+
+	// Add the new labels to the pods first, so both the legacy and the new
+	// selectors match them.
+	for _, pod := range pods.Items {
+		labels, err := newLabels(pod.Labels)
+		if err != nil {
+			log.Error("Failed to migrate labels of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			continue
+		}
+		namespaces[pod.Namespace] = labels
+		if _, err := client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, labelsPatch(labels), metav1.PatchOptions{}); err != nil {
+			log.Error("Failed to add labels to pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+
+	for _, service := range services.Items {
+		labels, err := newLabels(service.Labels)
+		if err != nil {
+			log.Error("Failed to migrate labels of service %s/%s: %v", service.Namespace, service.Name, err)
+			continue
+		}
+		namespaces[service.Namespace] = labels
+		if _, err := client.CoreV1().Services(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, mergePatch(map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": withoutLegacy(labels)},
+			"spec":     map[string]interface{}{"selector": withoutLegacy(labels)},
+		}), metav1.PatchOptions{}); err != nil {
+			log.Error("Failed to migrate labels of service %s/%s: %v", service.Namespace, service.Name, err)
+		}
+	}
+
+	for _, ingress := range ingresses.Items {
+		labels, err := newLabels(ingress.Labels)
+		if err != nil {
+			log.Error("Failed to migrate labels of ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
+			continue
+		}
+		namespaces[ingress.Namespace] = labels
+		if _, err := client.NetworkingV1().Ingresses(ingress.Namespace).Patch(ctx, ingress.Name, types.MergePatchType, labelsPatch(withoutLegacy(labels)), metav1.PatchOptions{}); err != nil {
+			log.Error("Failed to migrate labels of ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
+		}
+	}
+
+	// The services no longer select by the legacy labels, remove them from the
+	// pods.
+	for _, pod := range pods.Items {
+		if _, err := client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, labelsPatch(withoutLegacy(nil)), metav1.PatchOptions{}); err != nil {
+			log.Error("Failed to remove legacy labels from pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+
+	for namespace, labels := range namespaces {
+		if _, err := client.CoreV1().Namespaces().Patch(ctx, namespace, types.MergePatchType, labelsPatch(labels), metav1.PatchOptions{}); err != nil {
+			log.Error("Failed to add labels to namespace %s: %v", namespace, err)
+		}
+	}
+
+	if n := len(pods.Items) + len(services.Items) + len(ingresses.Items); n != 0 {
+		log.Info("Migrated legacy labels of %d resources in %d namespaces", n, len(namespaces))
+	}
+	return nil
+}
+
+func labelsPatch(labels map[string]interface{}) []byte {
+	return mergePatch(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+}
+
+func mergePatch(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package naming derives the names of the cluster resources of the instances.
+// Every name is an RFC 1123 label, which is what Kubernetes requires for
+// namespaces, services and containers.
+package naming
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/wuhan005/oblivion/internal/conf"
+)
+
+// MaxLength is the max length of an RFC 1123 label.
+const MaxLength = 63
+
+// hashLength is the length of the hash suffix of the names that have been
+// altered to be valid.
+const hashLength = 8
+
+// Name joins the given parts with "-" into an RFC 1123 label. The name is
+// lowercased, and the characters other than alphanumerics and "-" are
+// replaced with "-". If the name has been altered, or is longer than
+// MaxLength, it is truncated and suffixed with a hash of the joined parts, so
+// different parts never end up with the same name.
+func Name(parts ...string) string {
+	joined := strings.Join(parts, "-")
+
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '-':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, joined)
+	name = strings.Trim(name, "-")
+	if name == joined && len(name) <= MaxLength {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(joined))
+	hash := hex.EncodeToString(sum[:])[:hashLength]
+	if len(name) > MaxLength-hashLength-1 {
+		name = strings.TrimRight(name[:MaxLength-hashLength-1], "-")
+	}
+	if name == "" {
+		return hash
+	}
+	return name + "-" + hash
+}
+
+// Namespace returns the name of the namespace holding the resources of the
+// instance of the given image and user.
+func Namespace(imageUID, userDomain string) string {
+	return Name(imageUID, userDomain)
+}
+
+// Pod returns the name of the pod of the instance of the given image and
+// user, which is also the name of its container.
+func Pod(imageUID, userDomain string) string {
+	return Name(conf.Naming.Prefix, imageUID, userDomain, "pod")
+}
+
+// Service returns the name of the service routing to the HTTP port of the
+// instance of the given image and user.
+func Service(imageUID, userDomain string) string {
+	return Name(conf.Naming.Prefix, imageUID, userDomain, "service")
+}
+
+// ExposedService returns the name of the service exposing the TCP and UDP
+// ports of the instance of the given image and user.
+func ExposedService(imageUID, userDomain string) string {
+	return Name(conf.Naming.Prefix, imageUID, userDomain, "exposed")
+}
+
+// Ingress returns the name of the ingress of the instance of the given image
+// and user.
+func Ingress(imageUID, userDomain string) string {
+	return Name(conf.Naming.Prefix, imageUID, userDomain, "ingress")
+}
+
+// FlagSecret returns the name of the secret holding the flag of the instance
+// of the given image and user.
+func FlagSecret(imageUID, userDomain string) string {
+	return Name(conf.Naming.Prefix, imageUID, userDomain, "flag")
+}
+
+// Host returns the hostname routed to the instance of the given user under
+// the domain of the image.
+func Host(userDomain, imageDomain string) string {
+	return strings.ToLower(userDomain + "." + imageDomain)
+}
@@ -0,0 +1,614 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/wuhan005/oblivion/internal/conf"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/kubeutil"
+	"github.com/wuhan005/oblivion/internal/naming"
+)
+
+var _ Provisioner = (*kubernetesProvisioner)(nil)
+
+// NewKubernetesProvisioner returns a Provisioner running the instances in the
+// Kubernetes cluster of the given client.
+func NewKubernetesProvisioner(client kubernetes.Interface) Provisioner {
+	return &kubernetesProvisioner{client: client}
+}
+
+type kubernetesProvisioner struct {
+	client kubernetes.Interface
+}
+
+// Provision creates the namespace, the secret holding the flag and the pods
+// of the instance, the services of its containers, then the service and the
+// ingress of the HTTP port of its entrypoint, and the service exposing the TCP
+// and UDP ports of its entrypoint, in order. If any of them fails to be
+// created, the ones before it are deleted in reverse order, so the instance is
+// either fully provisioned or not at all.
+func (p *kubernetesProvisioner) Provision(ctx context.Context, instance Instance) error {
+	containers, err := instance.Image.GetContainers()
+	if err != nil {
+		return errors.Wrap(err, "get containers")
+	}
+	entrypoint, err := db.EntrypointContainer(containers)
+	if err != nil {
+		return err
+	}
+	httpPort, exposedPorts := splitPorts(entrypoint.Ports)
+
+	labels := kubeutil.Labels(instance.User.ID, instance.Image.UID)
+	namespace := instance.Namespace
+
+	steps := []provisionStep{
+		{
+			name: "namespace",
+			create: func(ctx context.Context) error {
+				_, err := p.client.CoreV1().Namespaces().Create(ctx, &v1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   namespace,
+						Labels: labels,
+					},
+				}, metav1.CreateOptions{})
+				return err
+			},
+			delete: func(ctx context.Context) error {
+				return p.client.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{})
+			},
+		},
+	}
+
+	if instance.Flag != "" {
+		secret := flagSecretManifest(instance, labels)
+		steps = append(steps, provisionStep{
+			name: "flag secret",
+			create: func(ctx context.Context) error {
+				_, err := p.client.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+				return err
+			},
+			delete: func(ctx context.Context) error {
+				return p.client.CoreV1().Secrets(namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{})
+			},
+		})
+	}
+
+	for _, container := range containers {
+		resources, err := container.Limitation.Resources()
+		if err != nil {
+			return errors.Wrapf(err, "parse limitation of container %q", container.Name)
+		}
+		pod := podManifest(instance, container, resources, labels)
+		steps = append(steps, provisionStep{
+			name: stepName("pod", container),
+			create: func(ctx context.Context) error {
+				_, err := p.client.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{})
+				return err
+			},
+			delete: func(ctx context.Context) error {
+				return p.client.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+			},
+		})
+
+		// The containers of a multi-container image reach each other by their
+		// names.
+		if container.Name == "" || len(container.Ports) == 0 {
+			continue
+		}
+		service := containerServiceManifest(instance, container, labels)
+		steps = append(steps, provisionStep{
+			name: stepName("service", container),
+			create: func(ctx context.Context) error {
+				_, err := p.client.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+				return err
+			},
+			delete: func(ctx context.Context) error {
+				return p.client.CoreV1().Services(namespace).Delete(ctx, service.Name, metav1.DeleteOptions{})
+			},
+		})
+	}
+
+	if httpPort != nil {
+		service := serviceManifest(instance, naming.Service(instance.Image.UID, instance.User.Domain), *httpPort, labels, containerLabels(labels, *entrypoint))
+		ingress := ingressManifest(instance, service.Name, *httpPort, labels)
+		steps = append(steps,
+			provisionStep{
+				name: "service",
+				create: func(ctx context.Context) error {
+					_, err := p.client.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+					return err
+				},
+				delete: func(ctx context.Context) error {
+					return p.client.CoreV1().Services(namespace).Delete(ctx, service.Name, metav1.DeleteOptions{})
+				},
+			},
+			provisionStep{
+				name: "ingress",
+				create: func(ctx context.Context) error {
+					_, err := p.client.NetworkingV1().Ingresses(namespace).Create(ctx, ingress, metav1.CreateOptions{})
+					return err
+				},
+				delete: func(ctx context.Context) error {
+					return p.client.NetworkingV1().Ingresses(namespace).Delete(ctx, ingress.Name, metav1.DeleteOptions{})
+				},
+			},
+		)
+	}
+
+	if len(exposedPorts) != 0 {
+		service := exposedServiceManifest(instance, exposedPorts, labels, containerLabels(labels, *entrypoint))
+		steps = append(steps, provisionStep{
+			name: "exposed service",
+			create: func(ctx context.Context) error {
+				_, err := p.client.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+				return err
+			},
+			delete: func(ctx context.Context) error {
+				return p.client.CoreV1().Services(namespace).Delete(ctx, service.Name, metav1.DeleteOptions{})
+			},
+		})
+	}
+
+	for i, step := range steps {
+		// The resources left behind by a previous attempt are taken over, so
+		// the retries converge.
+		err := step.create(ctx)
+		if err == nil || k8serrors.IsAlreadyExists(err) {
+			continue
+		}
+
+		if k8serrors.HasStatusCause(err, v1.NamespaceTerminatingCause) {
+			// The namespace of the previous instance, which has been taken
+			// over, is still being deleted.
+			err = ErrNamespaceTerminating
+		}
+		err = errors.Wrapf(err, "create %s", step.name)
+		if rollbackErr := rollback(steps[:i]); rollbackErr != nil {
+			return errors.Wrapf(err, "rollback failed: %v", rollbackErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// provisionStep creates a resource of an instance, and deletes it on rollback.
+type provisionStep struct {
+	name   string
+	create func(ctx context.Context) error
+	delete func(ctx context.Context) error
+}
+
+// rollbackTimeout is how long the rollback of a failed provisioning can take.
+const rollbackTimeout = 30 * time.Second
+
+// rollback deletes the resources created by the given steps in reverse order.
+// It does not use the context of the request, which may be the reason of the
+// failure.
+func rollback(steps []provisionStep) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(steps) - 1; i >= 0; i-- {
+		err := steps[i].delete(ctx)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			errs = append(errs, errors.Wrapf(err, "delete %s", steps[i].name))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// stepName returns the name of the provisioning step of the resource of the
+// given container.
+func stepName(resource string, container db.ImageContainer) string {
+	if container.Name == "" {
+		return resource
+	}
+	return fmt.Sprintf("%s of container %q", resource, container.Name)
+}
+
+// containerLabels returns the labels of the pod of the given container, which
+// select it among the pods of the instance.
+func containerLabels(labels map[string]string, container db.ImageContainer) map[string]string {
+	if container.Name == "" {
+		return labels
+	}
+	podLabels := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		podLabels[k] = v
+	}
+	podLabels[kubeutil.LabelContainer] = container.Name
+	return podLabels
+}
+
+// splitPorts returns the HTTP port, if any, and the TCP and UDP ports among the
+// given ports.
+func splitPorts(ports []db.ImagePort) (httpPort *db.ImagePort, exposedPorts []db.ImagePort) {
+	for i := range ports {
+		if ports[i].Protocol == db.ImagePortProtocolHTTP {
+			httpPort = &ports[i]
+			continue
+		}
+		exposedPorts = append(exposedPorts, ports[i])
+	}
+	return httpPort, exposedPorts
+}
+
+// protocol returns the transport protocol of the given port.
+func protocol(port db.ImagePort) v1.Protocol {
+	if port.Protocol == db.ImagePortProtocolUDP {
+		return v1.ProtocolUDP
+	}
+	return v1.ProtocolTCP
+}
+
+// flagSecretKey is the key of the flag in the flag secret of an instance.
+const flagSecretKey = "flag"
+
+// flagSecretManifest returns the secret holding the flag of the instance.
+func flagSecretManifest(instance Instance, labels map[string]string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      naming.FlagSecret(instance.Image.UID, instance.User.Domain),
+			Namespace: instance.Namespace,
+			Labels:    labels,
+		},
+		Type: v1.SecretTypeOpaque,
+		StringData: map[string]string{
+			flagSecretKey: instance.Flag,
+		},
+	}
+}
+
+// podManifest returns the pod of the given container. The only container of a
+// single-container image runs in the pod named after the instance.
+func podManifest(instance Instance, container db.ImageContainer, resources *db.ImageResources, labels map[string]string) *v1.Pod {
+	image := instance.Image
+	falseVal := false
+
+	name := container.Name
+	if name == "" {
+		name = instance.Name
+	}
+
+	containerPorts := make([]v1.ContainerPort, 0, len(container.Ports))
+	for _, port := range container.Ports {
+		containerPorts = append(containerPorts, v1.ContainerPort{
+			ContainerPort: port.Port,
+			Protocol:      protocol(port),
+		})
+	}
+	env := make([]v1.EnvVar, 0, len(container.Env))
+	for _, e := range container.Env {
+		env = append(env, v1.EnvVar{
+			Name:  e.Name,
+			Value: e.Value,
+		})
+	}
+
+	// The flag is read from the secret, so it does not show up in the pod spec.
+	// Only the entrypoint is given the flag, the helper containers such as the
+	// databases have no use for it.
+	var volumes []v1.Volume
+	var volumeMounts []v1.VolumeMount
+	if instance.Flag != "" && container.Entrypoint {
+		secretName := naming.FlagSecret(image.UID, instance.User.Domain)
+		if image.FlagEnv != "" {
+			env = append(env, v1.EnvVar{
+				Name: image.FlagEnv,
+				ValueFrom: &v1.EnvVarSource{
+					SecretKeyRef: &v1.SecretKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{Name: secretName},
+						Key:                  flagSecretKey,
+					},
+				},
+			})
+		}
+		if image.FlagPath != "" {
+			volumes = append(volumes, v1.Volume{
+				Name: "flag",
+				VolumeSource: v1.VolumeSource{
+					Secret: &v1.SecretVolumeSource{SecretName: secretName},
+				},
+			})
+			volumeMounts = append(volumeMounts, v1.VolumeMount{
+				Name:      "flag",
+				MountPath: image.FlagPath,
+				SubPath:   flagSecretKey,
+				ReadOnly:  true,
+			})
+		}
+	}
+
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: instance.Namespace,
+			Labels:    containerLabels(labels, container),
+		},
+		Spec: v1.PodSpec{
+			Volumes: volumes,
+			NodeSelector: map[string]string{
+				"challenge": image.UID,
+			},
+			Tolerations: []v1.Toleration{
+				{
+					Key:      "challenge",
+					Operator: v1.TolerationOpEqual,
+					Value:    image.UID,
+					Effect:   v1.TaintEffectNoSchedule,
+				},
+			},
+			Containers: []v1.Container{
+				{
+					Name:            name,
+					Image:           container.Image,
+					Ports:           containerPorts,
+					Env:             env,
+					VolumeMounts:    volumeMounts,
+					ImagePullPolicy: v1.PullIfNotPresent,
+					SecurityContext: &v1.SecurityContext{
+						AllowPrivilegeEscalation: &falseVal,
+					},
+					Resources: v1.ResourceRequirements{
+						Limits: v1.ResourceList{
+							v1.ResourceCPU:    resources.LimitsCPU,
+							v1.ResourceMemory: resources.LimitsMemory,
+						},
+						Requests: v1.ResourceList{
+							v1.ResourceCPU:    resources.RequestsCPU,
+							v1.ResourceMemory: resources.RequestsMemory,
+						},
+					},
+				},
+			},
+			AutomountServiceAccountToken: &falseVal,
+			EnableServiceLinks:           &falseVal,
+		},
+	}
+}
+
+func serviceManifest(instance Instance, name string, port db.ImagePort, labels, selector map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: instance.Namespace,
+			Labels:    labels,
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{
+					Name:       name,
+					Protocol:   v1.ProtocolTCP,
+					Port:       port.Port,
+					TargetPort: intstr.FromInt(int(port.Port)),
+				},
+			},
+			Selector: selector,
+		},
+	}
+}
+
+// containerServiceManifest returns the service named after the given
+// container, through which the other containers of the instance reach it.
+func containerServiceManifest(instance Instance, container db.ImageContainer, labels map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      container.Name,
+			Namespace: instance.Namespace,
+			Labels:    labels,
+		},
+		Spec: v1.ServiceSpec{
+			Ports:    servicePorts(container.Ports),
+			Selector: containerLabels(labels, container),
+		},
+	}
+}
+
+// servicePorts returns the service ports of the given ports, named after their
+// protocols and numbers.
+func servicePorts(ports []db.ImagePort) []v1.ServicePort {
+	servicePorts := make([]v1.ServicePort, 0, len(ports))
+	for _, port := range ports {
+		servicePorts = append(servicePorts, v1.ServicePort{
+			Name:       fmt.Sprintf("%s-%d", port.Protocol, port.Port),
+			Protocol:   protocol(port),
+			Port:       port.Port,
+			TargetPort: intstr.FromInt(int(port.Port)),
+		})
+	}
+	return servicePorts
+}
+
+// exposedServiceManifest returns the service exposing the given TCP and UDP
+// ports of the instance outside the cluster, on the ports allocated by the
+// cluster.
+func exposedServiceManifest(instance Instance, ports []db.ImagePort, labels, selector map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      naming.ExposedService(instance.Image.UID, instance.User.Domain),
+			Namespace: instance.Namespace,
+			Labels:    labels,
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceType(conf.Kubernetes.ExposeServiceType),
+			Ports:    servicePorts(ports),
+			Selector: selector,
+		},
+	}
+}
+
+func ingressManifest(instance Instance, serviceName string, port db.ImagePort, labels map[string]string) *networkingv1.Ingress {
+	pathType := networkingv1.PathTypePrefix
+	return &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      naming.Ingress(instance.Image.UID, instance.User.Domain),
+			Namespace: instance.Namespace,
+			Labels:    labels,
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: instance.Host,
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{
+								{
+									Path:     "/",
+									PathType: &pathType,
+									Backend: networkingv1.IngressBackend{
+										Service: &networkingv1.IngressServiceBackend{
+											Name: serviceName,
+											Port: networkingv1.ServiceBackendPort{
+												Number: port.Port,
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// Teardown deletes the ingresses, services and pods in the given instance
+// namespace, and then the namespace itself. The ingresses go first so the
+// hostname stops routing right away, while the namespace deletion catches
+// anything left behind.
+func (p *kubernetesProvisioner) Teardown(ctx context.Context, namespace string) error {
+	var errs []error
+
+	ingresses, err := p.client.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "list ingresses"))
+	} else {
+		for _, ingress := range ingresses.Items {
+			err := p.client.NetworkingV1().Ingresses(namespace).Delete(ctx, ingress.Name, metav1.DeleteOptions{})
+			if err != nil && !k8serrors.IsNotFound(err) {
+				errs = append(errs, errors.Wrapf(err, "delete ingress %q", ingress.Name))
+			}
+		}
+	}
+
+	services, err := p.client.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "list services"))
+	} else {
+		for _, service := range services.Items {
+			err := p.client.CoreV1().Services(namespace).Delete(ctx, service.Name, metav1.DeleteOptions{})
+			if err != nil && !k8serrors.IsNotFound(err) {
+				errs = append(errs, errors.Wrapf(err, "delete service %q", service.Name))
+			}
+		}
+	}
+
+	err = p.client.CoreV1().Pods(namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		errs = append(errs, errors.Wrap(err, "delete pods"))
+	}
+
+	err = p.client.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		errs = append(errs, errors.Wrap(err, "delete namespace"))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (p *kubernetesProvisioner) Status(ctx context.Context, namespace string) (*Status, error) {
+	list, err := p.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: kubeutil.ManagedSelector(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "list pods")
+	}
+	pods := make([]*v1.Pod, 0, len(list.Items))
+	for i := range list.Items {
+		pods = append(pods, &list.Items[i])
+	}
+	return InstanceStatus(pods), nil
+}
+
+func (p *kubernetesProvisioner) Endpoints(ctx context.Context, instance Instance) ([]Endpoint, error) {
+	ports, err := entrypointPorts(instance.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	var exposed *v1.Service
+	endpoints := make([]Endpoint, 0, len(ports))
+	for _, port := range ports {
+		endpoint := Endpoint{
+			Protocol: port.Protocol,
+			Port:     port.Port,
+		}
+		if port.Protocol == db.ImagePortProtocolHTTP {
+			endpoint.Host = instance.Host
+			endpoints = append(endpoints, endpoint)
+			continue
+		}
+
+		if exposed == nil {
+			name := naming.ExposedService(instance.Image.UID, instance.User.Domain)
+			exposed, err = p.client.CoreV1().Services(instance.Namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				if !k8serrors.IsNotFound(err) {
+					return nil, errors.Wrap(err, "get exposed service")
+				}
+				exposed = &v1.Service{}
+			}
+		}
+		endpoint.Host, endpoint.ExternalPort = exposedAddress(instance, exposed, port)
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// exposedAddress returns the host and the port the given port is exposed at by
+// the service, which are empty until allocated.
+func exposedAddress(instance Instance, service *v1.Service, port db.ImagePort) (string, int32) {
+	for _, servicePort := range service.Spec.Ports {
+		if servicePort.Port != port.Port || servicePort.Protocol != protocol(port) {
+			continue
+		}
+
+		if service.Spec.Type == v1.ServiceTypeLoadBalancer {
+			for _, ingress := range service.Status.LoadBalancer.Ingress {
+				if ingress.IP != "" {
+					return ingress.IP, servicePort.Port
+				}
+				if ingress.Hostname != "" {
+					return ingress.Hostname, servicePort.Port
+				}
+			}
+			return "", 0
+		}
+
+		if servicePort.NodePort == 0 {
+			return "", 0
+		}
+		host := conf.Kubernetes.NodeHost
+		if host == "" {
+			host = instance.Host
+		}
+		return host, servicePort.NodePort
+	}
+	return "", 0
+}
@@ -0,0 +1,387 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package orchestrator
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/wuhan005/oblivion/internal/conf"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/kubeutil"
+	"github.com/wuhan005/oblivion/internal/naming"
+)
+
+func setTestConf() {
+	conf.Naming.Prefix = "gamebox"
+	conf.Kubernetes.ExposeServiceType = "NodePort"
+	conf.Kubernetes.NodeHost = ""
+	conf.Resources.DefaultLimitsCPU = "500m"
+	conf.Resources.DefaultLimitsMemory = "512Mi"
+	conf.Resources.DefaultRequestsCPU = "100m"
+	conf.Resources.DefaultRequestsMemory = "128Mi"
+	conf.Resources.MaxCPU = "2"
+	conf.Resources.MaxMemory = "2Gi"
+}
+
+// testInstance returns an instance of an image exposing an HTTP and a TCP
+// port.
+func testInstance() Instance {
+	image := &db.Image{
+		UID:    "image",
+		Name:   "web",
+		Domain: "web.test",
+		Ports:  []byte(`[{"Port":80,"Protocol":"http"},{"Port":9999,"Protocol":"tcp"}]`),
+	}
+	user := &db.User{
+		Model:  gorm.Model{ID: 1},
+		Domain: "user",
+	}
+	return Instance{
+		Namespace: naming.Namespace(image.UID, user.Domain),
+		Name:      naming.Pod(image.UID, user.Domain),
+		Host:      naming.Host(user.Domain, image.Domain),
+		User:      user,
+		Image:     image,
+	}
+}
+
+// resourceActions returns the verb and the resource of the given actions of
+// the given verbs.
+func resourceActions(actions []k8stesting.Action, verbs ...string) []string {
+	var got []string
+	for _, action := range actions {
+		for _, verb := range verbs {
+			if action.GetVerb() == verb {
+				got = append(got, verb+" "+action.GetResource().Resource)
+			}
+		}
+	}
+	return got
+}
+
+func TestKubernetesProvisioner_Provision(t *testing.T) {
+	setTestConf()
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	provisioner := NewKubernetesProvisioner(client)
+	instance := testInstance()
+
+	if err := provisioner.Provision(ctx, instance); err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+
+	want := []string{
+		"create namespaces",
+		"create pods",
+		"create services",
+		"create ingresses",
+		"create services",
+	}
+	if got := resourceActions(client.Actions(), "create"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want creates %v, got %v", want, got)
+	}
+
+	labels := kubeutil.Labels(instance.User.ID, instance.Image.UID)
+	namespace, err := client.CoreV1().Namespaces().Get(ctx, instance.Namespace, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get namespace: %v", err)
+	}
+	if !reflect.DeepEqual(namespace.Labels, labels) {
+		t.Fatalf("Want namespace labels %v, got %v", labels, namespace.Labels)
+	}
+
+	pod, err := client.CoreV1().Pods(instance.Namespace).Get(ctx, instance.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get pod: %v", err)
+	}
+	if !reflect.DeepEqual(pod.Labels, labels) {
+		t.Fatalf("Want pod labels %v, got %v", labels, pod.Labels)
+	}
+	container := pod.Spec.Containers[0]
+	if got := container.Resources.Limits.Cpu().String(); got != "500m" {
+		t.Fatalf("Want the default CPU limit 500m, got %s", got)
+	}
+	if got := len(container.Ports); got != 2 {
+		t.Fatalf("Want 2 container ports, got %d", got)
+	}
+
+	service, err := client.CoreV1().Services(instance.Namespace).Get(ctx, naming.Service(instance.Image.UID, instance.User.Domain), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get service: %v", err)
+	}
+	if !reflect.DeepEqual(service.Spec.Selector, labels) {
+		t.Fatalf("Want service selector %v, got %v", labels, service.Spec.Selector)
+	}
+
+	ingress, err := client.NetworkingV1().Ingresses(instance.Namespace).Get(ctx, naming.Ingress(instance.Image.UID, instance.User.Domain), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ingress: %v", err)
+	}
+	if got := ingress.Spec.Rules[0].Host; got != instance.Host {
+		t.Fatalf("Want ingress host %q, got %q", instance.Host, got)
+	}
+	if got := ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name; got != service.Name {
+		t.Fatalf("Want ingress backend %q, got %q", service.Name, got)
+	}
+
+	exposed, err := client.CoreV1().Services(instance.Namespace).Get(ctx, naming.ExposedService(instance.Image.UID, instance.User.Domain), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get exposed service: %v", err)
+	}
+	if exposed.Spec.Type != v1.ServiceTypeNodePort {
+		t.Fatalf("Want exposed service type %s, got %s", v1.ServiceTypeNodePort, exposed.Spec.Type)
+	}
+	if got := exposed.Spec.Ports; len(got) != 1 || got[0].Port != 9999 || got[0].Protocol != v1.ProtocolTCP {
+		t.Fatalf("Want the exposed TCP port 9999, got %+v", got)
+	}
+}
+
+func TestKubernetesProvisioner_ProvisionFlag(t *testing.T) {
+	setTestConf()
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	provisioner := NewKubernetesProvisioner(client)
+	instance := testInstance()
+	instance.Flag = "flag{test}"
+	instance.Image.FlagEnv = "FLAG"
+	instance.Image.FlagPath = "/flag"
+	instance.Image.Containers = []byte(`[{"Name":"web","Image":"web","Ports":[{"Port":80,"Protocol":"http"}],"Entrypoint":true},{"Name":"db","Image":"mysql","Ports":[{"Port":3306,"Protocol":"tcp"}]}]`)
+
+	if err := provisioner.Provision(ctx, instance); err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+
+	pods, err := client.CoreV1().Pods(instance.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list pods: %v", err)
+	}
+	if got := len(pods.Items); got != 2 {
+		t.Fatalf("Want 2 pods, got %d", got)
+	}
+	for _, pod := range pods.Items {
+		container := pod.Spec.Containers[0]
+		var flagEnv bool
+		for _, env := range container.Env {
+			flagEnv = flagEnv || env.Name == "FLAG"
+		}
+		flagged := flagEnv || len(pod.Spec.Volumes) != 0 || len(container.VolumeMounts) != 0
+
+		switch container.Image {
+		case "web":
+			if !flagEnv || len(pod.Spec.Volumes) != 1 || len(container.VolumeMounts) != 1 {
+				t.Fatalf("Want the flag env and volume in the entrypoint, got env %+v and volumes %+v", container.Env, pod.Spec.Volumes)
+			}
+		case "mysql":
+			if flagged {
+				t.Fatalf("Want no flag in the helper container, got env %+v and volumes %+v", container.Env, pod.Spec.Volumes)
+			}
+		default:
+			t.Fatalf("Unexpected container image %q", container.Image)
+		}
+	}
+}
+
+func TestKubernetesProvisioner_ProvisionTakesOver(t *testing.T) {
+	setTestConf()
+	ctx := context.Background()
+	instance := testInstance()
+
+	// The namespace and the pod are left behind by a previous attempt.
+	client := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: instance.Namespace}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: instance.Name, Namespace: instance.Namespace}},
+	)
+	provisioner := NewKubernetesProvisioner(client)
+
+	if err := provisioner.Provision(ctx, instance); err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+	if got := resourceActions(client.Actions(), "delete"); len(got) != 0 {
+		t.Fatalf("Want nothing deleted, got %v", got)
+	}
+	ingresses, err := client.NetworkingV1().Ingresses(instance.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list ingresses: %v", err)
+	}
+	if got := len(ingresses.Items); got != 1 {
+		t.Fatalf("Want 1 ingress, got %d", got)
+	}
+}
+
+func TestKubernetesProvisioner_ProvisionRollback(t *testing.T) {
+	setTestConf()
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "ingresses", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("ingress admission denied")
+	})
+	provisioner := NewKubernetesProvisioner(client)
+	instance := testInstance()
+
+	err := provisioner.Provision(ctx, instance)
+	if err == nil {
+		t.Fatal("Want an error, got nil")
+	}
+
+	// The exposed service after the ingress is never created, and the ones
+	// before it are deleted in reverse order.
+	want := []string{
+		"create namespaces",
+		"create pods",
+		"create services",
+		"create ingresses",
+		"delete services",
+		"delete pods",
+		"delete namespaces",
+	}
+	if got := resourceActions(client.Actions(), "create", "delete"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want actions %v, got %v", want, got)
+	}
+	if _, err := client.CoreV1().Namespaces().Get(ctx, instance.Namespace, metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("Want the namespace deleted, got %v", err)
+	}
+}
+
+func TestKubernetesProvisioner_ProvisionNamespaceTerminating(t *testing.T) {
+	setTestConf()
+	ctx := context.Background()
+	instance := testInstance()
+
+	// The namespace of the previous instance is still being deleted, which
+	// forbids creating anything in it.
+	client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: instance.Namespace}})
+	client.PrependReactor("create", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		err := k8serrors.NewForbidden(schema.GroupResource{Resource: "pods"}, instance.Name, errors.New("namespace is being terminated"))
+		err.ErrStatus.Details.Causes = []metav1.StatusCause{{Type: v1.NamespaceTerminatingCause}}
+		return true, nil, err
+	})
+	provisioner := NewKubernetesProvisioner(client)
+
+	err := provisioner.Provision(ctx, instance)
+	if !errors.Is(err, ErrNamespaceTerminating) {
+		t.Fatalf("Want ErrNamespaceTerminating, got %v", err)
+	}
+}
+
+func TestKubernetesProvisioner_Teardown(t *testing.T) {
+	setTestConf()
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	provisioner := NewKubernetesProvisioner(client)
+	instance := testInstance()
+
+	if err := provisioner.Provision(ctx, instance); err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+	client.ClearActions()
+
+	if err := provisioner.Teardown(ctx, instance.Namespace); err != nil {
+		t.Fatalf("Failed to teardown: %v", err)
+	}
+	want := []string{
+		"delete ingresses",
+		"delete services",
+		"delete services",
+		"delete-collection pods",
+		"delete namespaces",
+	}
+	if got := resourceActions(client.Actions(), "delete", "delete-collection"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want actions %v, got %v", want, got)
+	}
+	if _, err := client.CoreV1().Namespaces().Get(ctx, instance.Namespace, metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("Want the namespace deleted, got %v", err)
+	}
+
+	// The resources already gone are ignored.
+	if err := provisioner.Teardown(ctx, instance.Namespace); err != nil {
+		t.Fatalf("Failed to teardown again: %v", err)
+	}
+}
+
+func TestKubernetesProvisioner_Status(t *testing.T) {
+	setTestConf()
+	ctx := context.Background()
+	instance := testInstance()
+	labels := kubeutil.Labels(instance.User.ID, instance.Image.UID)
+
+	newPod := func(name string, phase v1.PodPhase, conditions ...v1.PodConditionType) *v1.Pod {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: instance.Namespace,
+				Labels:    labels,
+			},
+			Status: v1.PodStatus{Phase: phase},
+		}
+		for _, condition := range conditions {
+			pod.Status.Conditions = append(pod.Status.Conditions, v1.PodCondition{
+				Type:   condition,
+				Status: v1.ConditionTrue,
+			})
+		}
+		return pod
+	}
+
+	tests := []struct {
+		name string
+		pods []runtime.Object
+		want Phase
+	}{
+		{
+			name: "no pod",
+			want: PhasePending,
+		},
+		{
+			name: "ready",
+			pods: []runtime.Object{
+				newPod("web", v1.PodRunning, v1.PodScheduled, v1.PodReady),
+			},
+			want: PhaseReady,
+		},
+		{
+			name: "least advanced pod",
+			pods: []runtime.Object{
+				newPod("web", v1.PodRunning, v1.PodScheduled, v1.PodReady),
+				newPod("db", v1.PodPending, v1.PodScheduled),
+			},
+			want: PhasePulling,
+		},
+		{
+			name: "unmanaged pod ignored",
+			pods: []runtime.Object{
+				newPod("web", v1.PodRunning, v1.PodScheduled, v1.PodReady),
+				&v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: instance.Namespace},
+					Status:     v1.PodStatus{Phase: v1.PodFailed},
+				},
+			},
+			want: PhaseReady,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provisioner := NewKubernetesProvisioner(fake.NewSimpleClientset(test.pods...))
+			status, err := provisioner.Status(ctx, instance.Namespace)
+			if err != nil {
+				t.Fatalf("Failed to get status: %v", err)
+			}
+			if status.Phase != test.want {
+				t.Fatalf("Want phase %s, got %s (%s)", test.want, status.Phase, status.Reason)
+			}
+		})
+	}
+}
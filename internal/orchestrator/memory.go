@@ -0,0 +1,206 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package orchestrator
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/wuhan005/oblivion/internal/db"
+)
+
+var _ Provisioner = (*memoryProvisioner)(nil)
+
+// MemoryOptions contains the options of the in-memory provisioner.
+type MemoryOptions struct {
+	// ReadyDelay is how long an instance takes to become ready, the first half
+	// of it is spent pulling the image.
+	ReadyDelay time.Duration
+	// FailureRate is the probability for an instance to fail to pull its image
+	// instead of becoming ready.
+	FailureRate float64
+	// ErrorRate is the probability for Provision to return an error.
+	ErrorRate float64
+	// OnStatus is called with the new status of an instance on every
+	// transition if not nil. It must not block or call the provisioner.
+	OnStatus func(namespace string, status *Status)
+}
+
+// NewMemoryProvisioner returns a Provisioner simulating the lifecycle of the
+// instances in memory, for the local development without a cluster.
+func NewMemoryProvisioner(opts MemoryOptions) Provisioner {
+	return &memoryProvisioner{
+		opts:         opts,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		instances:    make(map[string]*memoryInstance),
+		nextNodePort: memoryNodePortBase,
+	}
+}
+
+type memoryProvisioner struct {
+	opts MemoryOptions
+
+	mu        sync.Mutex
+	rand      *rand.Rand
+	instances map[string]*memoryInstance // Keyed by namespace.
+	// nextNodePort is the next simulated node port to allocate.
+	nextNodePort int32
+}
+
+// memoryNodePortBase is the first simulated node port, the start of the
+// default node port range of Kubernetes.
+const memoryNodePortBase = 30000
+
+// memoryInstance is a simulated instance, its status is advanced by the
+// timers.
+type memoryInstance struct {
+	status    *Status
+	timers    []*time.Timer
+	nodePorts map[db.ImagePort]int32
+}
+
+var errSimulated = errors.New("simulated provisioning failure")
+
+func (p *memoryProvisioner) Provision(_ context.Context, instance Instance) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	containers, err := instance.Image.GetContainers()
+	if err != nil {
+		return errors.Wrap(err, "get containers")
+	}
+	for _, container := range containers {
+		if _, err := container.Limitation.Resources(); err != nil {
+			return errors.Wrapf(err, "parse limitation of container %q", container.Name)
+		}
+	}
+	ports, err := entrypointPorts(instance.Image)
+	if err != nil {
+		return err
+	}
+	if p.rand.Float64() < p.opts.ErrorRate {
+		return errSimulated
+	}
+	if _, ok := p.instances[instance.Namespace]; ok {
+		return nil
+	}
+
+	fail := p.rand.Float64() < p.opts.FailureRate
+	mi := &memoryInstance{
+		nodePorts: make(map[db.ImagePort]int32),
+	}
+	_, exposedPorts := splitPorts(ports)
+	for _, port := range exposedPorts {
+		mi.nodePorts[port] = p.nextNodePort
+		p.nextNodePort++
+	}
+	p.instances[instance.Namespace] = mi
+	p.setStatus(instance.Namespace, mi, &Status{
+		Phase:  PhasePulling,
+		Reason: "Pulling the image",
+	})
+
+	pulled := &Status{
+		Phase:  PhaseRunning,
+		Reason: "Waiting for the containers to be ready",
+	}
+	if fail {
+		pulled = &Status{
+			Phase:  PhaseFailed,
+			Reason: "ErrImagePull: simulated image pull failure",
+		}
+	}
+	p.after(instance.Namespace, mi, p.opts.ReadyDelay/2, pulled)
+	if !fail {
+		p.after(instance.Namespace, mi, p.opts.ReadyDelay, &Status{
+			Phase: PhaseReady,
+			Ready: true,
+		})
+	}
+	return nil
+}
+
+// after sets the status of the instance after the given delay, unless it has
+// been torn down.
+func (p *memoryProvisioner) after(namespace string, mi *memoryInstance, delay time.Duration, status *Status) {
+	mi.timers = append(mi.timers, time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.instances[namespace] != mi {
+			return
+		}
+		p.setStatus(namespace, mi, status)
+	}))
+}
+
+// setStatus sets the status of the instance and reports it. It must be called
+// with the lock held.
+func (p *memoryProvisioner) setStatus(namespace string, mi *memoryInstance, status *Status) {
+	mi.status = status
+	if p.opts.OnStatus != nil {
+		p.opts.OnStatus(namespace, status)
+	}
+}
+
+func (p *memoryProvisioner) Teardown(_ context.Context, namespace string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mi, ok := p.instances[namespace]
+	if !ok {
+		return nil
+	}
+	for _, timer := range mi.timers {
+		timer.Stop()
+	}
+	delete(p.instances, namespace)
+	return nil
+}
+
+func (p *memoryProvisioner) Status(_ context.Context, namespace string) (*Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mi, ok := p.instances[namespace]
+	if !ok {
+		return &Status{
+			Phase:  PhasePending,
+			Reason: "Waiting for the pod to be created",
+		}, nil
+	}
+	status := *mi.status
+	return &status, nil
+}
+
+func (p *memoryProvisioner) Endpoints(_ context.Context, instance Instance) ([]Endpoint, error) {
+	ports, err := entrypointPorts(instance.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mi := p.instances[instance.Namespace]
+	endpoints := make([]Endpoint, 0, len(ports))
+	for _, port := range ports {
+		endpoint := Endpoint{
+			Protocol: port.Protocol,
+			Port:     port.Port,
+		}
+		if port.Protocol == db.ImagePortProtocolHTTP {
+			endpoint.Host = instance.Host
+		} else if mi != nil && mi.nodePorts[port] != 0 {
+			endpoint.Host = instance.Host
+			endpoint.ExternalPort = mi.nodePorts[port]
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package orchestrator
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/naming"
+)
+
+// Provisioner manages the resources of the instances in the cluster. Every
+// instance lives in its own namespace.
+type Provisioner interface {
+	// Provision creates the resources of the given instance. The created
+	// resources are deleted if it fails, and the ones that already exist are
+	// taken over, so it can be retried. It returns ErrNamespaceTerminating if
+	// the namespace of a previous instance is still being deleted.
+	Provision(ctx context.Context, instance Instance) error
+	// Teardown deletes every resource of the instance in the given namespace.
+	// The resources that are already gone are ignored.
+	Teardown(ctx context.Context, namespace string) error
+	// Status returns the live status of the instance in the given namespace.
+	Status(ctx context.Context, namespace string) (*Status, error)
+	// Endpoints returns the endpoints of every port of the given instance.
+	Endpoints(ctx context.Context, instance Instance) ([]Endpoint, error)
+}
+
+// ErrNamespaceTerminating is returned when provisioning an instance whose
+// namespace is still being deleted, which finishes asynchronously. The
+// provisioning succeeds once the namespace is gone.
+var ErrNamespaceTerminating = errors.New("namespace is being terminated")
+
+// Instance describes an instance to provision.
+type Instance struct {
+	// Namespace is the namespace holding the resources of the instance.
+	Namespace string
+	// Name is the name of the pod running the image.
+	Name string
+	// Host is the hostname routed to the instance.
+	Host string
+	// Flag is the flag injected into the containers, empty if the image has
+	// no flag template.
+	Flag string
+
+	User  *db.User
+	Image *db.Image
+}
+
+// Endpoint is where the players reach a port of an instance.
+type Endpoint struct {
+	Protocol db.ImagePortProtocol
+	// Port is the port of the container.
+	Port int32
+	// Host is the hostname or the IP address of the endpoint, it is empty
+	// until the cluster allocates it.
+	Host string
+	// ExternalPort is the port of the endpoint allocated by the cluster, it is
+	// zero for HTTP, which is served on the standard ports of the ingress, or
+	// until allocated.
+	ExternalPort int32
+}
+
+// entrypointPorts returns the ports of the entrypoint of the given image, which
+// are exposed to the players.
+func entrypointPorts(image *db.Image) ([]db.ImagePort, error) {
+	containers, err := image.GetContainers()
+	if err != nil {
+		return nil, errors.Wrap(err, "get containers")
+	}
+	entrypoint, err := db.EntrypointContainer(containers)
+	if err != nil {
+		return nil, err
+	}
+	return entrypoint.Ports, nil
+}
+
+// podInstance returns the instance of the given pod.
+func podInstance(pod *db.Pod) Instance {
+	return Instance{
+		Namespace: naming.Namespace(pod.Image.UID, pod.User.Domain),
+		Name:      pod.Name,
+		Host:      pod.Address,
+		Flag:      pod.Flag,
+		User:      pod.User,
+		Image:     pod.Image,
+	}
+}
+
+// ProvisionPod provisions the instance of the given pod, which is recorded in
+// the provisioning state beforehand so neither the expirer nor the reconciler
+// touches it within the reconcile grace period. The pod is marked as
+// provisioned on success, or deleted on failure so the next request starts
+// over. The pod is kept if its resources fail to be rolled back, and then
+// released once the grace period has passed.
+func ProvisionPod(ctx context.Context, provisioner Provisioner, pod *db.Pod) error {
+	instance := podInstance(pod)
+	if err := provisioner.Provision(ctx, instance); err != nil {
+		return releasePod(pod, errors.Wrap(err, "provision"))
+	}
+
+	if err := db.Pods.SetProvisioned(ctx, pod.ID); err != nil {
+		err = errors.Wrap(err, "set provisioned")
+		if teardownErr := provisioner.Teardown(context.Background(), instance.Namespace); teardownErr != nil {
+			return errors.Wrapf(err, "teardown failed: %v", teardownErr)
+		}
+		return releasePod(pod, err)
+	}
+	return nil
+}
+
+// releasePod deletes the record of the pod failed to be provisioned, and
+// returns the failure.
+func releasePod(pod *db.Pod, err error) error {
+	if deleteErr := db.Pods.Delete(context.Background(), pod.ID); deleteErr != nil {
+		return errors.Wrapf(err, "delete pod failed: %v", deleteErr)
+	}
+	return err
+}
+
+// TeardownPod deletes every resource of the given pod and then its database
+// record. The record is kept if any resource fails to be deleted, so the
+// teardown can be retried.
+func TeardownPod(ctx context.Context, provisioner Provisioner, pod *db.Pod) error {
+	if err := provisioner.Teardown(ctx, podInstance(pod).Namespace); err != nil {
+		return errors.Wrap(err, "teardown cluster resources")
+	}
+	if err := db.Pods.Delete(ctx, pod.ID); err != nil {
+		return errors.Wrap(err, "delete pod")
+	}
+	return nil
+}
+
+// PodEndpoints returns the endpoints of every port of the given pod.
+func PodEndpoints(ctx context.Context, provisioner Provisioner, pod *db.Pod) ([]Endpoint, error) {
+	return provisioner.Endpoints(ctx, podInstance(pod))
+}
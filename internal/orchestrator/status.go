@@ -0,0 +1,179 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Phase is the lifecycle phase of an instance as shown to the players.
+type Phase string
+
+const (
+	PhasePending          Phase = "Pending"
+	PhasePulling          Phase = "Pulling"
+	PhaseRunning          Phase = "Running"
+	PhaseReady            Phase = "Ready"
+	PhaseCrashLoopBackOff Phase = "CrashLoopBackOff"
+	PhaseFailed           Phase = "Failed"
+	PhaseTerminating      Phase = "Terminating"
+)
+
+// Status is the live status of an instance.
+type Status struct {
+	Phase        Phase
+	Ready        bool
+	RestartCount int32
+	Reason       string `json:",omitempty"`
+}
+
+// waitingFailureReasons are the reasons of a waiting container that need a
+// fix rather than more time.
+var waitingFailureReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// PodStatus derives the status of an instance from the conditions and the
+// container statuses of its pod.
+func PodStatus(pod *v1.Pod) *Status {
+	status := &Status{}
+	for _, container := range pod.Status.ContainerStatuses {
+		status.RestartCount += container.RestartCount
+	}
+
+	if pod.DeletionTimestamp != nil {
+		status.Phase = PhaseTerminating
+		return status
+	}
+
+	switch pod.Status.Phase {
+	case v1.PodFailed, v1.PodSucceeded:
+		status.Phase = PhaseFailed
+		status.Reason = joinReason(pod.Status.Reason, pod.Status.Message)
+		if status.Reason == "" {
+			status.Reason = "Pod has terminated"
+		}
+		return status
+	}
+
+	for _, container := range pod.Status.ContainerStatuses {
+		waiting := container.State.Waiting
+		if waiting == nil {
+			continue
+		}
+		switch {
+		case waiting.Reason == "CrashLoopBackOff":
+			status.Phase = PhaseCrashLoopBackOff
+			status.Reason = waiting.Message
+			if terminated := container.LastTerminationState.Terminated; terminated != nil {
+				status.Reason = fmt.Sprintf("Container %q exited with code %d: %s", container.Name, terminated.ExitCode, terminated.Reason)
+			}
+			return status
+		case waitingFailureReasons[waiting.Reason]:
+			status.Phase = PhaseFailed
+			status.Reason = joinReason(waiting.Reason, waiting.Message)
+			return status
+		}
+	}
+
+	if !hasCondition(pod, v1.PodScheduled) {
+		status.Phase = PhasePending
+		status.Reason = conditionMessage(pod, v1.PodScheduled)
+		if status.Reason == "" {
+			status.Reason = "Waiting for the pod to be scheduled"
+		}
+		return status
+	}
+
+	if pod.Status.Phase == v1.PodPending {
+		// The image is being pulled once the pod is scheduled and before any
+		// container starts.
+		status.Phase = PhasePulling
+		status.Reason = "Pulling the image"
+		return status
+	}
+
+	if hasCondition(pod, v1.PodReady) {
+		status.Phase = PhaseReady
+		status.Ready = true
+		return status
+	}
+	status.Phase = PhaseRunning
+	status.Reason = conditionMessage(pod, v1.PodReady)
+	if status.Reason == "" {
+		status.Reason = "Waiting for the containers to be ready"
+	}
+	return status
+}
+
+// phaseRanks orders the phases from the least to the most advanced.
+var phaseRanks = map[Phase]int{
+	PhaseFailed:           0,
+	PhaseCrashLoopBackOff: 1,
+	PhaseTerminating:      2,
+	PhasePending:          3,
+	PhasePulling:          4,
+	PhaseRunning:          5,
+	PhaseReady:            6,
+}
+
+// InstanceStatus derives the status of an instance from the pods of its
+// containers, which is the status of the least advanced pod. The restart
+// counts of the pods add up.
+func InstanceStatus(pods []*v1.Pod) *Status {
+	if len(pods) == 0 {
+		return &Status{
+			Phase:  PhasePending,
+			Reason: "Waiting for the pod to be created",
+		}
+	}
+
+	var status *Status
+	var restartCount int32
+	for _, pod := range pods {
+		podStatus := PodStatus(pod)
+		restartCount += podStatus.RestartCount
+		if status == nil || phaseRanks[podStatus.Phase] < phaseRanks[status.Phase] {
+			status = podStatus
+		}
+	}
+	status.RestartCount = restartCount
+	return status
+}
+
+func hasCondition(pod *v1.Pod, conditionType v1.PodConditionType) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func conditionMessage(pod *v1.Pod, conditionType v1.PodConditionType) string {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType {
+			return joinReason(condition.Reason, condition.Message)
+		}
+	}
+	return ""
+}
+
+func joinReason(reason, message string) string {
+	var parts []string
+	for _, part := range []string{reason, message} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ": ")
+}
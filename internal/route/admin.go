@@ -0,0 +1,85 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package route
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/flamego/flamego"
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/context"
+	"github.com/wuhan005/oblivion/internal/db"
+)
+
+// AdminAuther authenticates the admin API key passed as
+// "Authorization: Bearer <key>", and records every request performed with the
+// key into the audit logs. The paths are recorded along with their queries, so
+// the logs also tell who looked up which flag or pod.
+func AdminAuther(ctx context.Context) error {
+	key := bearerToken(ctx.Request().Request)
+	if key == "" {
+		return ctx.Error(40100, "Unauthorized")
+	}
+
+	adminKey, err := db.AdminKeys.GetByKey(ctx.Request().Context(), key)
+	if err != nil {
+		if errors.Is(err, db.ErrAdminKeyNotFound) {
+			return ctx.Error(40100, "Unauthorized")
+		}
+		log.Error("Failed to get admin key: %v", err)
+		return ctx.ServerError()
+	}
+	ctx.Map(adminKey)
+
+	ctx.Next()
+
+	if err := db.AuditLogs.Create(ctx.Request().Context(), db.CreateAuditLogOptions{
+		AdminKeyID:   adminKey.ID,
+		AdminKeyName: adminKey.Name,
+		Method:       ctx.Request().Method,
+		Path:         ctx.Request().URL.RequestURI(),
+		StatusCode:   ctx.ResponseWriter().Status(),
+		RemoteAddr:   ctx.RemoteAddr(),
+	}); err != nil {
+		log.Error("Failed to create audit log: %v", err)
+	}
+	return nil
+}
+
+// RequireScope rejects the request if the admin API key is not granted the
+// given scope.
+func RequireScope(scope db.AdminScope) flamego.Handler {
+	return func(ctx context.Context, adminKey *db.AdminKey) error {
+		if !adminKey.HasScope(scope) {
+			return ctx.Error(40300, "Admin key does not have the %q scope", scope)
+		}
+		return nil
+	}
+}
+
+func ListAuditLogs(ctx context.Context) error {
+	auditLogs, err := db.AuditLogs.List(ctx.Request().Context(), db.ListAuditLogsOptions{
+		AdminKeyID: uint(ctx.QueryInt("adminKeyID")),
+		Limit:      100,
+	})
+	if err != nil {
+		log.Error("Failed to list audit logs: %v", err)
+		return ctx.ServerError()
+	}
+	return ctx.Success(auditLogs)
+}
+
+// bearerToken returns the token in the "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
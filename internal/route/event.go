@@ -0,0 +1,99 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/flamego/flamego"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/context"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/event"
+	"github.com/wuhan005/oblivion/internal/naming"
+	"github.com/wuhan005/oblivion/internal/orchestrator"
+)
+
+// eventsKeepAliveInterval is the interval of the comments sent to keep the
+// idle connection alive through proxies.
+const eventsKeepAliveInterval = 15 * time.Second
+
+// PodEvents streams the lifecycle events of the caller's instance as
+// Server-Sent Events. The current status is sent first on connection.
+func PodEvents(ctx context.Context, user *db.User, image *db.Image, provisioner orchestrator.Provisioner, hub *event.Hub) error {
+	namespace := naming.Namespace(image.UID, user.Domain)
+	events, unsubscribe := hub.Subscribe(namespace)
+	defer unsubscribe()
+
+	pods, err := db.Pods.Get(ctx.Request().Context(), db.GetPodsOptions{
+		UserID:  user.ID,
+		ImageID: image.ID,
+	})
+	if err != nil {
+		log.Error("Failed to get pods: %v", err)
+		return ctx.ServerError()
+	}
+
+	w := ctx.ResponseWriter()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	current := event.Event{Type: event.TypeDeleted}
+	if len(pods) != 0 {
+		status, err := provisioner.Status(ctx.Request().Context(), namespace)
+		if err != nil {
+			log.Error("Failed to get pod status: %v", err)
+		}
+		current = event.Event{
+			Type:      event.TypeStatus,
+			Status:    status,
+			ExpiredAt: &pods[0].ExpiredAt,
+		}
+	}
+	current.Time = time.Now()
+	if err := writeEvent(w, current); err != nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(eventsKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := writeEvent(w, e); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func writeEvent(w flamego.ResponseWriter, e event.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package route
+
+import (
+	"strings"
+	"time"
+
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/context"
+	"github.com/wuhan005/oblivion/internal/db"
+)
+
+// flagOwner is an instance a flag has been issued to.
+type flagOwner struct {
+	PodID      uint
+	UserID     uint
+	UserDomain string
+	ImageID    uint
+	ImageName  string
+	IssuedAt   time.Time
+	// DeletedAt is when the instance was deleted, nil if it is still running.
+	DeletedAt *time.Time
+}
+
+// LookupFlagForm is the request body of a flag lookup. The flag is taken from
+// the body rather than the query, so it is kept out of the audit logs.
+type LookupFlagForm struct {
+	Flag string
+}
+
+// LookupFlag returns the instances the given flag has been issued to, even
+// the deleted ones, so a flag submitted by another user gives away the sharing.
+func LookupFlag(ctx context.Context) error {
+	var f LookupFlagForm
+	if err := ctx.BindJSON(&f); err != nil {
+		return ctx.Error(40000, "Invalid request body: %v", err)
+	}
+	flag := strings.TrimSpace(f.Flag)
+	if flag == "" {
+		return ctx.Error(40000, "flag is required")
+	}
+
+	pods, err := db.Pods.GetByFlag(ctx.Request().Context(), flag)
+	if err != nil {
+		log.Error("Failed to get pods by flag: %v", err)
+		return ctx.ServerError()
+	}
+	if len(pods) == 0 {
+		return ctx.Error(40400, "Flag not found")
+	}
+
+	owners := make([]flagOwner, 0, len(pods))
+	for _, pod := range pods {
+		owner := flagOwner{
+			PodID:      pod.ID,
+			UserID:     pod.UserID,
+			UserDomain: pod.User.Domain,
+			ImageID:    pod.ImageID,
+			ImageName:  pod.Image.Name,
+			IssuedAt:   pod.CreatedAt,
+		}
+		if pod.DeletedAt.Valid {
+			owner.DeletedAt = &pod.DeletedAt.Time
+		}
+		owners = append(owners, owner)
+	}
+	return ctx.Success(owners)
+}
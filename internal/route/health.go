@@ -0,0 +1,29 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package route
+
+import (
+	"github.com/wuhan005/oblivion/internal/context"
+	"github.com/wuhan005/oblivion/internal/cron"
+)
+
+// Health reports the last-run status of the background jobs. It is public, so
+// the errors of the jobs, which may reveal the internals of the database and
+// the cluster, are left out. They are listed by ListJobs.
+func Health(ctx context.Context, runner *cron.Runner) error {
+	statuses := runner.Statuses()
+	for i := range statuses {
+		statuses[i].LastError = ""
+	}
+	return ctx.Success(map[string]interface{}{
+		"jobs": statuses,
+	})
+}
+
+// ListJobs returns the statuses of the background jobs along with their last
+// errors.
+func ListJobs(ctx context.Context, runner *cron.Runner) error {
+	return ctx.Success(runner.Statuses())
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package route
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/context"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/event"
+	"github.com/wuhan005/oblivion/internal/naming"
+	"github.com/wuhan005/oblivion/internal/orchestrator"
+)
+
+type ImageForm struct {
+	Name   string
+	Domain string
+	Ports  []db.ImagePort
+	// Port is the HTTP port of the image, it is used when no port is given in
+	// Ports.
+	//
+	// Deprecated: Use Ports instead.
+	Port       int32
+	Limitation db.ImageLimitation
+	// Containers makes a multi-container image, whose ports and limitations
+	// are set on the containers. The name of the image is then only its
+	// identifier.
+	Containers []db.ImageContainer
+	// TTL, MaxLifetime and RenewWindow are duration strings like "1h30m", the
+	// same format as the config file.
+	TTL         Duration
+	MaxLifetime Duration
+	MaxRenewals int
+	RenewWindow Duration
+	// FlagTemplate gives every user a unique flag, which is injected into the
+	// entrypoint container as the FlagEnv environment variable, "FLAG" if
+	// neither it nor FlagPath is given, and as the FlagPath file.
+	FlagTemplate string
+	FlagEnv      string
+	FlagPath     string
+}
+
+// Duration is a time.Duration bound from a duration string in JSON. An integer
+// is still taken as nanoseconds for the existing clients.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case string:
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	case float64:
+		*d = Duration(v)
+	case nil:
+		*d = 0
+	default:
+		return errors.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+func (f *ImageForm) validate() error {
+	if f.Name == "" {
+		return errors.New("name is required")
+	}
+	if f.Domain == "" {
+		return errors.New("domain is required")
+	}
+	if f.TTL < 0 || f.MaxLifetime < 0 || f.RenewWindow < 0 {
+		return errors.New("durations must not be negative")
+	}
+	if f.MaxLifetime > 0 && f.TTL > f.MaxLifetime {
+		return errors.New("TTL must not exceed the max lifetime")
+	}
+
+	if f.FlagTemplate != "" && f.FlagEnv == "" && f.FlagPath == "" {
+		f.FlagEnv = "FLAG"
+	}
+	if err := db.ValidateFlag(f.FlagTemplate, f.FlagEnv, f.FlagPath); err != nil {
+		return err
+	}
+
+	if len(f.Containers) != 0 {
+		if len(f.Ports) != 0 || f.Port != 0 || f.Limitation != (db.ImageLimitation{}) {
+			return errors.New("ports and limitation must be set on the containers")
+		}
+		return db.ValidateContainers(f.Containers)
+	}
+
+	if len(f.Ports) == 0 && f.Port != 0 {
+		f.Ports = []db.ImagePort{{Port: f.Port, Protocol: db.ImagePortProtocolHTTP}}
+	}
+	if err := db.ValidatePorts(f.Ports); err != nil {
+		return err
+	}
+	if _, err := f.Limitation.Resources(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func ListImages(ctx context.Context) error {
+	images, err := db.Images.List(ctx.Request().Context())
+	if err != nil {
+		log.Error("Failed to list images: %v", err)
+		return ctx.ServerError()
+	}
+	return ctx.Success(images)
+}
+
+// Imager maps the image of the "uid" parameter for the admin routes.
+func Imager(ctx context.Context) error {
+	image, err := db.Images.GetByUID(ctx.Request().Context(), ctx.Param("uid"))
+	if err != nil {
+		if errors.Is(err, db.ErrImageNotFound) {
+			return ctx.Error(40400, "Image not found")
+		}
+		log.Error("Failed to get image by uid: %v", err)
+		return ctx.ServerError()
+	}
+	ctx.Map(image)
+	return nil
+}
+
+func GetImage(ctx context.Context, image *db.Image) error {
+	return ctx.Success(image)
+}
+
+func CreateImage(ctx context.Context) error {
+	var f ImageForm
+	if err := ctx.BindJSON(&f); err != nil {
+		return ctx.Error(40000, "Invalid request body: %v", err)
+	}
+	if err := f.validate(); err != nil {
+		return ctx.Error(40000, "%v", err)
+	}
+
+	image, err := db.Images.Create(ctx.Request().Context(), db.CreateImageOptions{
+		Name:         f.Name,
+		Domain:       f.Domain,
+		Ports:        f.Ports,
+		Limitation:   f.Limitation,
+		Containers:   f.Containers,
+		TTL:          time.Duration(f.TTL),
+		MaxLifetime:  time.Duration(f.MaxLifetime),
+		MaxRenewals:  f.MaxRenewals,
+		RenewWindow:  time.Duration(f.RenewWindow),
+		FlagTemplate: f.FlagTemplate,
+		FlagEnv:      f.FlagEnv,
+		FlagPath:     f.FlagPath,
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrDuplicateImage) {
+			return ctx.Error(40900, "Image has already existed")
+		}
+		log.Error("Failed to create image: %v", err)
+		return ctx.ServerError()
+	}
+	return ctx.Success(image)
+}
+
+func UpdateImage(ctx context.Context, image *db.Image) error {
+	var f ImageForm
+	if err := ctx.BindJSON(&f); err != nil {
+		return ctx.Error(40000, "Invalid request body: %v", err)
+	}
+	if err := f.validate(); err != nil {
+		return ctx.Error(40000, "%v", err)
+	}
+
+	if err := db.Images.Update(ctx.Request().Context(), image.ID, db.UpdateImageOptions{
+		Name:         f.Name,
+		Domain:       f.Domain,
+		Ports:        f.Ports,
+		Limitation:   f.Limitation,
+		Containers:   f.Containers,
+		TTL:          time.Duration(f.TTL),
+		MaxLifetime:  time.Duration(f.MaxLifetime),
+		MaxRenewals:  f.MaxRenewals,
+		RenewWindow:  time.Duration(f.RenewWindow),
+		FlagTemplate: f.FlagTemplate,
+		FlagEnv:      f.FlagEnv,
+		FlagPath:     f.FlagPath,
+	}); err != nil {
+		if errors.Is(err, db.ErrImageNotFound) {
+			return ctx.Error(40400, "Image not found")
+		}
+		if errors.Is(err, db.ErrDuplicateImage) {
+			return ctx.Error(40900, "Image has already existed")
+		}
+		log.Error("Failed to update image: %v", err)
+		return ctx.ServerError()
+	}
+
+	image, err := db.Images.GetByID(ctx.Request().Context(), image.ID)
+	if err != nil {
+		log.Error("Failed to get image by ID: %v", err)
+		return ctx.ServerError()
+	}
+	return ctx.Success(image)
+}
+
+// DeleteImage tears down the instances of the image and then deletes it. The
+// image is kept if any of its instances fails to be torn down, so the deletion
+// can be retried.
+func DeleteImage(ctx context.Context, image *db.Image, provisioner orchestrator.Provisioner, hub *event.Hub) error {
+	pods, err := db.Pods.Get(ctx.Request().Context(), db.GetPodsOptions{
+		ImageID: image.ID,
+	})
+	if err != nil {
+		log.Error("Failed to get pods: %v", err)
+		return ctx.ServerError()
+	}
+	for _, pod := range pods {
+		if err := orchestrator.TeardownPod(ctx.Request().Context(), provisioner, pod); err != nil {
+			log.Error("Failed to teardown pod %d of image %q: %v", pod.ID, image.UID, err)
+			return ctx.ServerError()
+		}
+		hub.Publish(naming.Namespace(image.UID, pod.User.Domain), event.Event{Type: event.TypeDeleted})
+	}
+
+	if err := db.Images.Delete(ctx.Request().Context(), image.ID); err != nil {
+		log.Error("Failed to delete image: %v", err)
+		return ctx.ServerError()
+	}
+	return ctx.Success()
+}
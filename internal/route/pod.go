@@ -5,25 +5,36 @@
 package route
 
 import (
-	"fmt"
-	"time"
-
 	"github.com/pkg/errors"
-	v1 "k8s.io/api/core/v1"
-	networkingv1 "k8s.io/api/networking/v1"
-	k8serrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/intstr"
-	"k8s.io/client-go/kubernetes"
 	log "unknwon.dev/clog/v2"
 
+	"github.com/wuhan005/oblivion/internal/conf"
 	"github.com/wuhan005/oblivion/internal/context"
 	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/dbutil"
+	"github.com/wuhan005/oblivion/internal/event"
+	"github.com/wuhan005/oblivion/internal/naming"
+	"github.com/wuhan005/oblivion/internal/orchestrator"
 )
 
+// UserAuther authenticates the player token passed as
+// "Authorization: Bearer <token>", in the token cookie, or with the deprecated
+// "?token=" query parameter if it is enabled.
 func UserAuther(ctx context.Context) error {
-	token := ctx.Query("token")
+	token := bearerToken(ctx.Request().Request)
+	if token == "" && conf.Auth.CookieName != "" {
+		token = ctx.Cookie(conf.Auth.CookieName)
+	}
+	if token == "" && conf.Auth.EnableQueryToken {
+		token = ctx.Query("token")
+		if token != "" {
+			ctx.ResponseWriter().Header().Set("Deprecation", "true")
+		}
+	}
+	if token == "" {
+		return ctx.Error(40100, "token is required")
+	}
+
 	user, err := db.Users.GetByToken(ctx.Request().Context(), token)
 	if err != nil {
 		if errors.Is(err, db.ErrUserNotFound) {
@@ -51,21 +62,20 @@ func Enver(ctx context.Context) error {
 	return nil
 }
 
-func CreatePod(ctx context.Context, user *db.User, image *db.Image, k8sClient *kubernetes.Clientset) error {
+func ListPods(ctx context.Context) error {
 	pods, err := db.Pods.Get(ctx.Request().Context(), db.GetPodsOptions{
-		UserID:  user.ID,
-		ImageID: image.ID,
+		UserID:  uint(ctx.QueryInt("userID")),
+		ImageID: uint(ctx.QueryInt("imageID")),
 	})
 	if err != nil {
 		log.Error("Failed to get pods: %v", err)
 		return ctx.ServerError()
 	}
+	return ctx.Success(pods)
+}
 
-	if len(pods) != 0 {
-		return ctx.Success(pods[0])
-	}
-
-	pods, err = db.Pods.Get(ctx.Request().Context(), db.GetPodsOptions{
+func CreatePod(ctx context.Context, user *db.User, image *db.Image, provisioner orchestrator.Provisioner, hub *event.Hub) error {
+	pods, err := db.Pods.Get(ctx.Request().Context(), db.GetPodsOptions{
 		UserID:  user.ID,
 		ImageID: image.ID,
 	})
@@ -74,173 +84,123 @@ func CreatePod(ctx context.Context, user *db.User, image *db.Image, k8sClient *k
 		return ctx.ServerError()
 	}
 	if len(pods) != 0 {
-		return ctx.Error(40300, "Pod has been created")
+		return ctx.Success(withStatus(ctx, provisioner, pods[0]))
 	}
 
-	namespace := fmt.Sprintf("%s-%s", image.UID, user.Domain)
-	_, err = k8sClient.CoreV1().Namespaces().Create(ctx.Request().Context(),
-		&v1.Namespace{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: namespace,
-			},
-		}, metav1.CreateOptions{})
-	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		log.Error("Failed to create namespace: %v", err)
+	// Record the pod before provisioning, so its resources are never left
+	// behind without a record. The record also reserves the instance of the
+	// user and the image, only one of the concurrent requests gets to create
+	// it.
+	containers, err := image.GetContainers()
+	if err != nil {
+		log.Error("Failed to get containers of image %q: %v", image.UID, err)
 		return ctx.ServerError()
 	}
-
-	// Create pod in cluster.
-	podName := fmt.Sprintf("gamebox-%s-%s-pod", image.UID, user.Domain)
-	podPort := image.Port
-	falseVal := false
-	limitation := image.GetLimitation()
-	_, err = k8sClient.CoreV1().Pods(namespace).Create(ctx.Request().Context(), &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      podName,
-			Namespace: namespace,
-			Labels: map[string]string{
-				"team_token": user.Token,
-				"image_uid":  image.UID,
-			},
-		},
-		Spec: v1.PodSpec{
-			NodeSelector: map[string]string{
-				"challenge": image.UID,
-			},
-			Tolerations: []v1.Toleration{
-				{
-					Key:      "challenge",
-					Operator: v1.TolerationOpEqual,
-					Value:    image.UID,
-					Effect:   v1.TaintEffectNoSchedule,
-				},
-			},
-			Containers: []v1.Container{
-				{
-					Name:  podName,
-					Image: image.Name,
-					Ports: []v1.ContainerPort{
-						{
-							ContainerPort: podPort,
-						},
-					},
-					ImagePullPolicy: v1.PullIfNotPresent,
-					SecurityContext: &v1.SecurityContext{
-						AllowPrivilegeEscalation: &falseVal,
-					},
-					Resources: v1.ResourceRequirements{
-						Limits: v1.ResourceList{
-							v1.ResourceCPU:    resource.MustParse(limitation.LimitsCPU),
-							v1.ResourceMemory: resource.MustParse(limitation.LimitsMemory),
-						},
-						Requests: v1.ResourceList{
-							v1.ResourceCPU:    resource.MustParse(limitation.RequestsCPU),
-							v1.ResourceMemory: resource.MustParse(limitation.RequestsMemory),
-						},
-					},
-				},
-			},
-			AutomountServiceAccountToken: &falseVal,
-			EnableServiceLinks:           &falseVal,
-		},
-	}, metav1.CreateOptions{})
-	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		log.Error("Failed to create pod in cluster: %v", err)
+	namespace := naming.Namespace(image.UID, user.Domain)
+	pod, err := db.Pods.Create(ctx.Request().Context(), db.CreatePodOptions{
+		UserID:     user.ID,
+		ImageID:    image.ID,
+		Name:       naming.Pod(image.UID, user.Domain),
+		Address:    naming.Host(user.Domain, image.Domain),
+		ExpiredAt:  dbutil.Now().Add(image.GetTTL()),
+		Flag:       image.RenderFlag(user.ID),
+		Containers: len(containers),
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrDuplicatePod) {
+			// A teammate is creating the instance concurrently.
+			return existingPod(ctx, user, image, provisioner)
+		}
+		log.Error("Failed to create pod: %v", err)
 		return ctx.ServerError()
 	}
+	pod.User = user
+	pod.Image = image
 
-	// Create service for pod.
-	serviceName := fmt.Sprintf("gamebox-%s-%s-service", namespace, user.Domain)
-	servicePort := intstr.FromInt(int(podPort))
-	_, err = k8sClient.CoreV1().Services(namespace).Create(ctx.Request().Context(), &v1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      serviceName,
-			Namespace: namespace,
-			Labels: map[string]string{
-				"team_token": user.Token,
-				"image_uid":  image.UID,
-			},
-		},
-		Spec: v1.ServiceSpec{
-			Ports: []v1.ServicePort{
-				{
-					Name:       serviceName,
-					Protocol:   v1.ProtocolTCP,
-					Port:       podPort,
-					TargetPort: servicePort,
-				},
-			},
-			Selector: map[string]string{
-				"team_token": user.Token,
-				"image_uid":  image.UID,
-			},
-		},
-	}, metav1.CreateOptions{})
-	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		log.Error("Failed to create service: %v", err)
+	if err := orchestrator.ProvisionPod(ctx.Request().Context(), provisioner, pod); err != nil {
+		if errors.Is(err, orchestrator.ErrNamespaceTerminating) {
+			return ctx.Error(40900, "Previous pod is still being deleted, please retry")
+		}
+		log.Error("Failed to provision pod: %v", err)
 		return ctx.ServerError()
 	}
+	pod.State = db.PodStateProvisioned
 
-	address := user.Domain + "." + image.Domain
+	hub.Publish(namespace, event.Event{
+		Type:      event.TypeCreated,
+		ExpiredAt: &pod.ExpiredAt,
+	})
+	return ctx.Success(withStatus(ctx, provisioner, pod))
+}
 
-	// Create ingress for pod with address domain.
-	ingressName := fmt.Sprintf("gamebox-%s-%s-ingress", namespace, user.Domain)
-	pathType := networkingv1.PathType("Prefix")
-	_, err = k8sClient.NetworkingV1().Ingresses(namespace).Create(ctx.Request().Context(), &networkingv1.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      ingressName,
-			Namespace: namespace,
-			Labels: map[string]string{
-				"team_token": user.Token,
-				"image_uid":  image.UID,
-			},
-		},
-		Spec: networkingv1.IngressSpec{
-			Rules: []networkingv1.IngressRule{
-				{
-					Host: address,
-					IngressRuleValue: networkingv1.IngressRuleValue{
-						HTTP: &networkingv1.HTTPIngressRuleValue{
-							Paths: []networkingv1.HTTPIngressPath{
-								{
-									Path:     "/",
-									PathType: &pathType,
-									Backend: networkingv1.IngressBackend{
-										Service: &networkingv1.IngressServiceBackend{
-											Name: serviceName,
-											Port: networkingv1.ServiceBackendPort{
-												Number: podPort,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	}, metav1.CreateOptions{})
-	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		log.Error("Failed to create pod ingress: %v", err)
+// existingPod responds with the pod of the user and the image created by
+// another request.
+func existingPod(ctx context.Context, user *db.User, image *db.Image, provisioner orchestrator.Provisioner) error {
+	pods, err := db.Pods.Get(ctx.Request().Context(), db.GetPodsOptions{
+		UserID:  user.ID,
+		ImageID: image.ID,
+	})
+	if err != nil {
+		log.Error("Failed to get pods: %v", err)
 		return ctx.ServerError()
 	}
+	if len(pods) == 0 {
+		// The other request has failed and released the pod.
+		return ctx.Error(40900, "Pod failed to be created, please retry")
+	}
+	return ctx.Success(withStatus(ctx, provisioner, pods[0]))
+}
 
-	pod, err := db.Pods.Create(ctx.Request().Context(), db.CreatePodOptions{
-		UserID:    user.ID,
-		ImageID:   image.ID,
-		Name:      podName,
-		Address:   address,
-		ExpiredAt: time.Now().Add(1 * time.Hour),
+// podResponse is a pod along with the live status and the endpoints of its
+// instance.
+type podResponse struct {
+	*db.Pod
+	Status    *orchestrator.Status
+	Endpoints []orchestrator.Endpoint
+}
+
+func withStatus(ctx context.Context, provisioner orchestrator.Provisioner, pod *db.Pod) *podResponse {
+	namespace := naming.Namespace(pod.Image.UID, pod.User.Domain)
+	status, err := provisioner.Status(ctx.Request().Context(), namespace)
+	if err != nil {
+		log.Error("Failed to get pod status: %v", err)
+	}
+	endpoints, err := orchestrator.PodEndpoints(ctx.Request().Context(), provisioner, pod)
+	if err != nil {
+		log.Error("Failed to get pod endpoints: %v", err)
+	}
+	return &podResponse{
+		Pod:       pod,
+		Status:    status,
+		Endpoints: endpoints,
+	}
+}
+
+func DeletePod(ctx context.Context, user *db.User, image *db.Image, provisioner orchestrator.Provisioner, hub *event.Hub) error {
+	pods, err := db.Pods.Get(ctx.Request().Context(), db.GetPodsOptions{
+		UserID:  user.ID,
+		ImageID: image.ID,
 	})
 	if err != nil {
-		log.Error("Failed to create pod: %v", err)
+		log.Error("Failed to get pods: %v", err)
 		return ctx.ServerError()
 	}
-	return ctx.Success(pod)
+
+	if len(pods) == 0 {
+		return ctx.Error(40400, "Pod not found")
+	}
+	if err := orchestrator.TeardownPod(ctx.Request().Context(), provisioner, pods[0]); err != nil {
+		log.Error("Failed to teardown pod: %v", err)
+		return ctx.ServerError()
+	}
+	hub.Publish(naming.Namespace(image.UID, user.Domain), event.Event{Type: event.TypeDeleted})
+	return ctx.Success()
 }
 
-func DeletePod(ctx context.Context, user *db.User, image *db.Image, k8sClient *kubernetes.Clientset) error {
+// RenewPod extends the expiry time of the pod by the TTL of its image. The pod
+// can only be renewed within the renewal window before it expires, for a
+// limited number of times, and not beyond the max lifetime of the image.
+func RenewPod(ctx context.Context, user *db.User, image *db.Image) error {
 	pods, err := db.Pods.Get(ctx.Request().Context(), db.GetPodsOptions{
 		UserID:  user.ID,
 		ImageID: image.ID,
@@ -249,34 +209,44 @@ func DeletePod(ctx context.Context, user *db.User, image *db.Image, k8sClient *k
 		log.Error("Failed to get pods: %v", err)
 		return ctx.ServerError()
 	}
-
 	if len(pods) == 0 {
 		return ctx.Error(40400, "Pod not found")
 	}
 	pod := pods[0]
 
-	namespace := fmt.Sprintf("%s-%s", image.UID, user.Domain)
-
-	// Delete ingress.
-	ingressName := fmt.Sprintf("gamebox-%s-%s-ingress", namespace, user.Domain)
-	if err := k8sClient.NetworkingV1().Ingresses(namespace).Delete(ctx.Request().Context(), ingressName, metav1.DeleteOptions{}); err != nil {
-		log.Error("Failed to delete ingress: %v", err)
+	now := dbutil.Now()
+	if remaining := pod.ExpiredAt.Sub(now); remaining > image.GetRenewWindow() {
+		return ctx.Error(40300, "Pod can only be renewed within %v before it expires", image.GetRenewWindow())
+	}
+	if pod.Renewals >= image.GetMaxRenewals() {
+		return ctx.Error(40300, "Pod has reached the renewal limit")
 	}
 
-	// Delete service.
-	serviceName := fmt.Sprintf("gamebox-%s-%s-service", namespace, user.Domain)
-	if err := k8sClient.CoreV1().Services(namespace).Delete(ctx.Request().Context(), serviceName, metav1.DeleteOptions{}); err != nil {
-		log.Error("Failed to delete service: %v", err)
+	expiredAt := now.Add(image.GetTTL())
+	if image.MaxLifetime > 0 {
+		if maxExpiredAt := pod.CreatedAt.Add(image.MaxLifetime); expiredAt.After(maxExpiredAt) {
+			expiredAt = maxExpiredAt
+		}
+	}
+	if !expiredAt.After(pod.ExpiredAt) {
+		return ctx.Error(40300, "Pod has reached the max lifetime")
 	}
 
-	// Delete pods in cluster.
-	if err := k8sClient.CoreV1().Pods(namespace).Delete(ctx.Request().Context(), pod.Name, metav1.DeleteOptions{}); err != nil {
-		log.Error("Failed to delete pod in cluster: %v", err)
+	if err := db.Pods.Renew(ctx.Request().Context(), pod.ID, db.RenewPodOptions{
+		Renewals:  pod.Renewals,
+		ExpiredAt: expiredAt,
+	}); err != nil {
+		if errors.Is(err, db.ErrPodRenewed) {
+			return ctx.Error(40900, "Pod has been renewed")
+		}
+		log.Error("Failed to renew pod: %v", err)
+		return ctx.ServerError()
 	}
 
-	if err := db.Pods.Delete(ctx.Request().Context(), pod.ID); err != nil {
-		log.Error("Failed to delete pod: %v", err)
+	pod, err = db.Pods.GetByID(ctx.Request().Context(), pod.ID)
+	if err != nil {
+		log.Error("Failed to get pod by ID: %v", err)
 		return ctx.ServerError()
 	}
-	return ctx.Success()
+	return ctx.Success(pod)
 }
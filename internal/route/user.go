@@ -0,0 +1,64 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package route
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/wuhan005/oblivion/internal/context"
+	"github.com/wuhan005/oblivion/internal/db"
+	"github.com/wuhan005/oblivion/internal/userutil"
+)
+
+// ImportUsers creates users in batch from the request body, which is either a
+// JSON array of tokens or a CSV file with the "text/csv" content type. The
+// "generate" query parameter creates the given number of users with random
+// tokens in addition. The response is the only place to see the plaintext
+// tokens.
+func ImportUsers(ctx context.Context) error {
+	format := userutil.TokensFormatJSON
+	mediaType, _, _ := mime.ParseMediaType(ctx.Request().Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		format = userutil.TokensFormatCSV
+	}
+
+	generate := ctx.QueryInt("generate")
+	if generate < 0 {
+		return ctx.Error(40000, "Invalid number of tokens to generate")
+	}
+
+	var tokens []string
+	if ctx.Request().ContentLength != 0 {
+		var err error
+		tokens, err = userutil.ParseTokens(ctx.Request().Body().ReadCloser(), format)
+		if err != nil {
+			return ctx.Error(40000, "Invalid request body: %v", err)
+		}
+	}
+	if len(tokens) == 0 && generate == 0 {
+		return ctx.Error(40000, "No token is given")
+	}
+
+	users, err := db.Users.BatchCreate(ctx.Request().Context(), db.BatchCreateOptions{
+		Tokens:   tokens,
+		Generate: generate,
+	})
+	if err != nil {
+		var duplicateErr *db.DuplicateUsersError
+		if errors.As(err, &duplicateErr) {
+			return ctx.Error(40900, "Duplicate tokens: %s", strings.Join(duplicateErr.Tokens, ", "))
+		}
+		if errors.Is(err, db.ErrDuplicateUser) {
+			return ctx.Error(40900, "Duplicate tokens")
+		}
+		log.Error("Failed to batch create users: %v", err)
+		return ctx.ServerError()
+	}
+	return ctx.Success(users)
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 E99p1ant. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package userutil
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TokensFormat is the format of a list of user tokens.
+type TokensFormat string
+
+const (
+	TokensFormatCSV  TokensFormat = "csv"
+	TokensFormatJSON TokensFormat = "json"
+)
+
+// ParseTokens reads the user tokens from r in the given format. A CSV list
+// takes the first column of every row, with an optional "token" header. A
+// JSON list is an array of strings. Blank tokens are skipped.
+func ParseTokens(r io.Reader, format TokensFormat) ([]string, error) {
+	var tokens []string
+	switch format {
+	case TokensFormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, errors.Wrap(err, "read csv")
+		}
+		for i, record := range records {
+			if i == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "token") {
+				continue
+			}
+			tokens = append(tokens, record[0])
+		}
+
+	case TokensFormatJSON:
+		if err := json.NewDecoder(r).Decode(&tokens); err != nil {
+			return nil, errors.Wrap(err, "decode json")
+		}
+
+	default:
+		return nil, errors.Errorf("unsupported format %q", format)
+	}
+
+	parsed := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		token = strings.TrimSpace(token)
+		if token != "" {
+			parsed = append(parsed, token)
+		}
+	}
+	return parsed, nil
+}